@@ -0,0 +1,460 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIKeyHeader is the header APIKeyAuthenticator reads the API key
+// from.
+const APIKeyHeader = "X-API-Key"
+
+// MethodAPIKey is the method of principals authenticated with an API
+// key.
+const MethodAPIKey = "apikey"
+
+// APIKeyKind is the datastore kind of the APIKey entities.
+var APIKeyKind string = "APIKey"
+
+// APIKeyTouchInterval is how old an APIKey's LastUsed must be before
+// using it updates it. It saves a datastore write on every request.
+var APIKeyTouchInterval time.Duration = time.Minute
+
+// APIKey is a long-lived credential for a principal. Only a hash of
+// its secret is stored, so the token is only known when the key is
+// issued or rotated.
+type APIKey struct {
+	// Owner is the name of the principal the key acts for (e.g.
+	// their email).
+	Owner string
+
+	// Name describes what the key is for.
+	Name string
+
+	// Scopes are the scopes the key was granted.
+	Scopes []string
+
+	// Hash is the SHA-256 hash of the secret.
+	Hash []byte `json:"-" xml:"-" msgpack:"-" cbor:"-"`
+
+	Created  time.Time
+	LastUsed time.Time
+
+	// Expires is when the key stops working. The zero time never
+	// expires.
+	Expires time.Time
+
+	// Revoked keys don't work anymore.
+	Revoked bool
+}
+
+// NewAPIKey is the response sent when an API key is issued or
+// rotated. The Token is what clients send in the APIKeyHeader.
+type NewAPIKey struct {
+	Key    string
+	Token  string
+	APIKey *APIKey
+}
+
+// APIKeyRequest is the body of a request to issue an API key.
+type APIKeyRequest struct {
+	Name    string `validate:"required"`
+	Scopes  []string
+	Expires time.Time
+}
+
+// newAPIKeySecret returns a random secret and its hash.
+func newAPIKeySecret() (string, []byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	hash := sha256.Sum256([]byte(secret))
+	return secret, hash[:], nil
+}
+
+// apiKeyToken returns the token for the key and secret.
+func apiKeyToken(key *datastore.Key, secret string) string {
+	return key.Encode() + "." + secret
+}
+
+// getAPIKey fetches the API key for the given key.
+func getAPIKey(c Context, key *datastore.Key) (*APIKey, error) {
+	aks := make([]APIKey, 1)
+	if err := c.GetMulti([]*datastore.Key{key}, aks); err != nil {
+		return nil, err
+	}
+
+	return &aks[0], nil
+}
+
+// putAPIKey stores the API key.
+func putAPIKey(c Context, key *datastore.Key, ak *APIKey) error {
+	_, err := c.PutMulti([]*datastore.Key{key}, []*APIKey{ak})
+	return err
+}
+
+// IssueAPIKey stores a new API key for the owner with the given name,
+// scopes, and expiration (the zero time never expires). It returns the
+// key of the APIKey entity and the token to give to the client.
+func IssueAPIKey(c Context, owner, name string, scopes []string,
+	expires time.Time) (*datastore.Key, string, error) {
+
+	secret, hash, err := newAPIKeySecret()
+	if err != nil {
+		return nil, "", err
+	}
+
+	id, _, err := c.AllocateIDs(APIKeyKind, nil, 1)
+	if err != nil {
+		return nil, "", err
+	}
+	key := c.NewKey(APIKeyKind, "", id, nil)
+
+	ak := &APIKey{
+		Owner:   owner,
+		Name:    name,
+		Scopes:  scopes,
+		Hash:    hash,
+		Created: time.Now(),
+		Expires: expires,
+	}
+	if err := putAPIKey(c, key, ak); err != nil {
+		return nil, "", err
+	}
+
+	return key, apiKeyToken(key, secret), nil
+}
+
+// RevokeAPIKey stops the API key from working.
+func RevokeAPIKey(c Context, key *datastore.Key) error {
+	return c.RunInTransaction(func(tc Context) error {
+		ak, err := getAPIKey(tc, key)
+		if err != nil {
+			return err
+		}
+
+		ak.Revoked = true
+		return putAPIKey(tc, key, ak)
+	}, false)
+}
+
+// RotateAPIKey gives the API key a new secret and returns its new
+// token. The old token stops working. Revoked keys can't be rotated.
+func RotateAPIKey(c Context, key *datastore.Key) (string, error) {
+	secret, hash, err := newAPIKeySecret()
+	if err != nil {
+		return "", err
+	}
+
+	err = c.RunInTransaction(func(tc Context) error {
+		ak, err := getAPIKey(tc, key)
+		if err != nil {
+			return err
+		}
+		if ak.Revoked {
+			return ErrFailed.Wrap(fmt.Errorf("%v is revoked", key))
+		}
+
+		ak.Hash = hash
+		return putAPIKey(tc, key, ak)
+	}, false)
+	if err != nil {
+		return "", err
+	}
+
+	return apiKeyToken(key, secret), nil
+}
+
+// touchAPIKey sets the LastUsed of the API key to now. The key is
+// read again in a transaction and only LastUsed is changed, so a
+// concurrent revoke or rotate isn't undone.
+func touchAPIKey(c Context, key *datastore.Key) error {
+	return c.RunInTransaction(func(tc Context) error {
+		ak, err := getAPIKey(tc, key)
+		if err != nil {
+			return err
+		}
+
+		ak.LastUsed = time.Now()
+		return putAPIKey(tc, key, ak)
+	}, false)
+}
+
+// CheckAPIKey returns the key and APIKey for the token if it is
+// valid. Tokens that are unknown, revoked, or expired are an
+// ErrUnauthorized.
+func CheckAPIKey(c Context, token string) (*datastore.Key, *APIKey,
+	error) {
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, nil, ErrUnauthorized.Wrap(
+			errors.New("malformed api key"))
+	}
+
+	key, err := datastore.DecodeKey(parts[0])
+	if err != nil || key.Kind() != APIKeyKind {
+		return nil, nil, ErrUnauthorized.Wrap(fmt.Errorf("bad api key %q",
+			parts[0]))
+	}
+
+	ak, err := getAPIKey(c, key)
+	if me, ok := err.(appengine.MultiError); ok &&
+		me[0] == datastore.ErrNoSuchEntity {
+
+		return nil, nil, ErrUnauthorized.Wrap(fmt.Errorf("no api key %v",
+			key))
+	} else if err != nil {
+		return nil, nil, DatastoreError(err)
+	}
+
+	hash := sha256.Sum256([]byte(parts[1]))
+	switch {
+	case subtle.ConstantTimeCompare(hash[:], ak.Hash) != 1:
+		return nil, nil, ErrUnauthorized.Wrap(fmt.Errorf("wrong secret "+
+			"for api key %v", key))
+	case ak.Revoked:
+		return nil, nil, ErrUnauthorized.Wrap(fmt.Errorf("api key %v "+
+			"is revoked", key))
+	case !ak.Expires.IsZero() && time.Now().After(ak.Expires):
+		return nil, nil, ErrUnauthorized.Wrap(fmt.Errorf("api key %v "+
+			"expired at %v", key, ak.Expires))
+	}
+
+	return key, ak, nil
+}
+
+// APIKeyAuthenticator authenticates requests with the API key in their
+// APIKeyHeader. The principal's ID is the key's Owner, they are never
+// an admin, and they only have the roles of the Owner that are among
+// the key's scopes (see RequireRolesOrFail). Keys that aren't valid get
+// an ErrUnauthorized.
+type APIKeyAuthenticator struct {
+	// Scopes are the scopes the key must have been granted.
+	Scopes []string
+}
+
+// Authenticate implements Authenticator.
+func (a *APIKeyAuthenticator) Authenticate(c Context,
+	r *http.Request) (*Principal, error) {
+
+	token := r.Header.Get(APIKeyHeader)
+	if token == "" {
+		return nil, nil
+	}
+
+	key, ak, err := CheckAPIKey(c, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasScopes(ak.Scopes, a.Scopes) {
+		return nil, ErrUnauthorized.Wrap(fmt.Errorf("api key %v "+
+			"doesn't have scopes %v", key, a.Scopes))
+	}
+
+	if time.Since(ak.LastUsed) >= APIKeyTouchInterval {
+		if err := touchAPIKey(c, key); err != nil {
+			Log(c, r, "warn", "updating last use of %v: %v", key, err)
+		}
+	}
+
+	return &Principal{
+		ID:     ak.Owner,
+		Method: MethodAPIKey,
+		Scopes: ak.Scopes,
+	}, nil
+}
+
+// Challenge implements Authenticator. API keys have no challenge.
+func (a *APIKeyAuthenticator) Challenge() string {
+	return ""
+}
+
+// APIKeyHandler serves the JSON endpoints that manage the API keys of
+// the authenticated principal:
+//
+//	GET    Prefix        lists their API keys.
+//	POST   Prefix        issues an API key for the APIKeyRequest in the
+//	                     body and sends a NewAPIKey.
+//	GET    Prefix + key  sends the API key.
+//	POST   Prefix + key  rotates the API key and sends a NewAPIKey.
+//	DELETE Prefix + key  revokes the API key.
+//
+// The API keys of others are not found. Principals authenticated
+// with an API key can't use it.
+type APIKeyHandler struct {
+	// Prefix is the URL path the API keys are served under
+	// (e.g. "/apikeys/").
+	Prefix string
+
+	// Chain authenticates the requests. If it is nil, the
+	// DefaultAuthChain is used.
+	Chain AuthChain
+
+	// NewContext makes the Context for a request. If it is nil, the
+	// package NewContext is used.
+	NewContext func(r *http.Request) Context
+}
+
+// ServeHTTP implements http.Handler.
+func (ah *APIKeyHandler) ServeHTTP(w http.ResponseWriter,
+	r *http.Request) {
+
+	c := contextFor(ah.NewContext, r)
+
+	p, ok := AuthenticateOrFail(c, w, r, ah.Chain)
+	if !ok {
+		return
+	}
+
+	// A leaked key mustn't be able to mint more keys.
+	if p.Method == MethodAPIKey {
+		LogAndError(c, w, r, ErrUnauthorized.Wrap(fmt.Errorf("api keys "+
+			"can't manage the api keys of %s", p.name())))
+		return
+	}
+	owner := p.name()
+
+	skey, ok := splitPrefix(r.URL.Path, ah.Prefix)
+	if !ok {
+		LogAndNotFound(c, w, r, fmt.Errorf("%s not in %s", r.URL.Path,
+			ah.Prefix))
+		return
+	}
+
+	if skey == "" {
+		switch r.Method {
+		case "GET":
+			ah.list(c, w, r, owner)
+		case "POST":
+			ah.issue(c, w, r, owner)
+		default:
+			notAllowed(c, w, r, "GET, POST")
+		}
+		return
+	}
+
+	key, ak, ok := ah.get(c, w, r, owner, skey)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		WriteData(c, w, r, Entity{Key: skey, Value: ak})
+
+	case "POST":
+		token, err := RotateAPIKey(c, key)
+		if err != nil {
+			LogAndError(c, w, r, DatastoreError(err))
+			return
+		}
+		WriteData(c, w, r, NewAPIKey{Key: skey, Token: token, APIKey: ak})
+
+	case "DELETE":
+		if err := RevokeAPIKey(c, key); err != nil {
+			LogAndError(c, w, r, DatastoreError(err))
+			return
+		}
+		WriteSuccessMessage(c, w, r)
+
+	default:
+		notAllowed(c, w, r, "GET, POST, DELETE")
+	}
+}
+
+// list sends the owner's API keys.
+func (ah *APIKeyHandler) list(c Context, w http.ResponseWriter,
+	r *http.Request, owner string) {
+
+	var aks []APIKey
+	keys, err := c.GetAll(&Query{
+		Kind:    APIKeyKind,
+		Filters: []Filter{{Property: "Owner", Op: "=", Value: owner}},
+	}, &aks)
+	if err != nil {
+		LogAndError(c, w, r, DatastoreError(err))
+		return
+	}
+
+	entities := make([]Entity, len(keys))
+	for x, key := range keys {
+		entities[x] = Entity{Key: key.Encode(), Value: aks[x]}
+	}
+	WriteData(c, w, r, entities)
+}
+
+// issue issues an API key for the owner.
+func (ah *APIKeyHandler) issue(c Context, w http.ResponseWriter,
+	r *http.Request, owner string) {
+
+	var req APIKeyRequest
+	if !UnmarshalFromBodyOrFail(c, w, r, &req) {
+		return
+	}
+
+	key, token, err := IssueAPIKey(c, owner, req.Name, req.Scopes,
+		req.Expires)
+	if err != nil {
+		LogAndError(c, w, r, DatastoreError(err))
+		return
+	}
+
+	ak, err := getAPIKey(c, key)
+	if err != nil {
+		LogAndError(c, w, r, DatastoreError(err))
+		return
+	}
+
+	w.Header().Set("Location", ah.Prefix+key.Encode())
+	writeData(c, w, r, NewAPIKey{Key: key.Encode(), Token: token,
+		APIKey: ak}, http.StatusCreated)
+}
+
+// get fetches the owner's API key for the string key. Keys that
+// aren't API keys or belong to someone else are not found. If a
+// failure occured, false is returned and a response was returned to
+// the request.
+func (ah *APIKeyHandler) get(c Context, w http.ResponseWriter,
+	r *http.Request, owner, skey string) (*datastore.Key, *APIKey, bool) {
+
+	key, ok := StringToKey(c, w, r, skey)
+	if !ok {
+		return nil, nil, false
+	}
+	if key.Kind() != APIKeyKind {
+		LogAndNotFound(c, w, r, fmt.Errorf("key %v is not a %s", key,
+			APIKeyKind))
+		return nil, nil, false
+	}
+
+	ak, err := getAPIKey(c, key)
+	if err != nil {
+		LogAndError(c, w, r, DatastoreError(err))
+		return nil, nil, false
+	}
+	if ak.Owner != owner {
+		LogAndNotFound(c, w, r, fmt.Errorf("%s doesn't own %v", owner,
+			key))
+		return nil, nil, false
+	}
+
+	return key, ak, true
+}
@@ -0,0 +1,320 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"encoding/json"
+	"github.com/icub3d/gorca/internal/testhelper"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyHandler(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	ah := &APIKeyHandler{
+		Prefix:     "/apikeys/",
+		NewContext: func(r *http.Request) Context { return c },
+	}
+
+	// serve is a helper that sends a request to the handler as the
+	// given user.
+	serve := func(email, method, url,
+		body string) *httptest.ResponseRecorder {
+
+		c.Logout()
+		if email != "" {
+			c.Login(email, false)
+		}
+
+		var b io.Reader
+		if body != "" {
+			b = strings.NewReader(body)
+		}
+		r, err := http.NewRequest(method, url, b)
+		h.FatalNotNil("creating request", err)
+
+		w := httptest.NewRecorder()
+		ah.ServeHTTP(w, r)
+		return w
+	}
+
+	// Issue a key.
+	h.SetFunc("POST /apikeys/")
+	w := serve("owner@example.com", "POST", "/apikeys/",
+		`{"Name":"partner","Scopes":["read"]}`)
+	h.FatalNotEqual("response code", w.Code, http.StatusCreated)
+
+	var issued NewAPIKey
+	err := json.Unmarshal(w.Body.Bytes(), &issued)
+	h.FatalNotNil("unmarshal", err)
+	h.ErrorNotEqual("owner", issued.APIKey.Owner, "owner@example.com")
+	h.ErrorNotEqual("scopes", issued.APIKey.Scopes, []string{"read"})
+	h.ErrorNotEqual("hash hidden", strings.Contains(w.Body.String(),
+		"Hash"), false)
+	h.ErrorNotEqual("location", w.Header().Get("Location"),
+		"/apikeys/"+issued.Key)
+
+	// The key can't be used to manage keys.
+	keyed := &APIKeyHandler{
+		Prefix:     "/apikeys/",
+		Chain:      AuthChain{&APIKeyAuthenticator{}, CookieAuthenticator{}},
+		NewContext: func(r *http.Request) Context { return c },
+	}
+	c.Logout()
+	r := newRequest("POST", "/apikeys/",
+		strings.NewReader(`{"Name":"more","Scopes":["admin"]}`))
+	r.Header.Set(APIKeyHeader, issued.Token)
+	w = httptest.NewRecorder()
+	keyed.ServeHTTP(w, r)
+	h.ErrorNotEqual("keyed response code", w.Code, http.StatusForbidden)
+
+	url := "/apikeys/" + issued.Key
+	tests := []struct {
+		email  string
+		method string
+		url    string
+		body   string
+		ecode  int
+	}{
+		// No one is logged in.
+		{method: "GET", url: "/apikeys/", ecode: http.StatusUnauthorized},
+
+		// A key needs a name.
+		{
+			email:  "owner@example.com",
+			method: "POST",
+			url:    "/apikeys/",
+			body:   `{"Scopes":["read"]}`,
+			ecode:  http.StatusUnprocessableEntity,
+		},
+
+		// List and get the owner's key.
+		{
+			email:  "owner@example.com",
+			method: "GET",
+			url:    "/apikeys/",
+			ecode:  http.StatusOK,
+		},
+		{
+			email:  "owner@example.com",
+			method: "GET",
+			url:    url,
+			ecode:  http.StatusOK,
+		},
+
+		// Someone else's key isn't found.
+		{
+			email:  "other@example.com",
+			method: "GET",
+			url:    url,
+			ecode:  http.StatusNotFound,
+		},
+		{
+			email:  "other@example.com",
+			method: "DELETE",
+			url:    url,
+			ecode:  http.StatusNotFound,
+		},
+
+		// Not an API key.
+		{
+			email:  "owner@example.com",
+			method: "GET",
+			url:    "/apikeys/" + c.NewKey("Other", "", 1, nil).Encode(),
+			ecode:  http.StatusNotFound,
+		},
+
+		// Not allowed.
+		{
+			email:  "owner@example.com",
+			method: "PUT",
+			url:    url,
+			ecode:  http.StatusMethodNotAllowed,
+		},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+		h.SetFunc(test.method + " " + test.url)
+
+		w := serve(test.email, test.method, test.url, test.body)
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+	}
+
+	// The list only has the owner's key.
+	h.SetFunc("GET /apikeys/")
+	w = serve("other@example.com", "GET", "/apikeys/", "")
+	h.ErrorNotEqual("other's list", w.Body.String(), "[]")
+
+	// Rotating changes the token.
+	h.SetFunc("POST " + url)
+	w = serve("owner@example.com", "POST", url, "")
+	h.FatalNotEqual("response code", w.Code, http.StatusOK)
+
+	var rotated NewAPIKey
+	err = json.Unmarshal(w.Body.Bytes(), &rotated)
+	h.FatalNotNil("unmarshal", err)
+	h.ErrorNotEqual("rotated key", rotated.Key, issued.Key)
+	h.ErrorNotEqual("new token", rotated.Token != issued.Token, true)
+
+	_, _, err = CheckAPIKey(c, issued.Token)
+	h.ErrorNil("old token", err)
+	_, _, err = CheckAPIKey(c, rotated.Token)
+	h.ErrorNotNil("new token", err)
+
+	// Revoking stops it from working.
+	h.SetFunc("DELETE " + url)
+	w = serve("owner@example.com", "DELETE", url, "")
+	h.FatalNotEqual("response code", w.Code, http.StatusOK)
+
+	_, _, err = CheckAPIKey(c, rotated.Token)
+	h.ErrorNil("revoked token", err)
+
+	w = serve("owner@example.com", "POST", url, "")
+	h.ErrorNotEqual("rotate revoked", w.Code, http.StatusBadRequest)
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	_, valid, err := IssueAPIKey(c, "owner@example.com", "valid",
+		[]string{"read"}, time.Time{})
+	h.FatalNotNil("issue valid", err)
+	_, expired, err := IssueAPIKey(c, "owner@example.com", "expired",
+		[]string{"read"}, time.Now().Add(-time.Hour))
+	h.FatalNotNil("issue expired", err)
+	key, revoked, err := IssueAPIKey(c, "owner@example.com", "revoked",
+		[]string{"read"}, time.Time{})
+	h.FatalNotNil("issue revoked", err)
+	h.FatalNotNil("revoke", RevokeAPIKey(c, key))
+
+	unauthorized := `{"Type":"error","Message":"You are not authorized ` +
+		`to do that."}`
+
+	tests := []struct {
+		token  string
+		scopes []string
+		ecode  int
+		ebody  string
+	}{
+		// No key.
+		{
+			ecode: http.StatusUnauthorized,
+			ebody: `{"Type":"error","Message":"You must be logged in ` +
+				`to do that."}`,
+		},
+
+		// A valid key.
+		{token: valid, scopes: []string{"read"}, ecode: http.StatusOK},
+
+		// A missing scope.
+		{
+			token:  valid,
+			scopes: []string{"write"},
+			ecode:  http.StatusForbidden,
+			ebody:  unauthorized,
+		},
+
+		// A wrong secret.
+		{
+			token: strings.SplitN(valid, ".", 2)[0] + ".wrong",
+			ecode: http.StatusForbidden,
+			ebody: unauthorized,
+		},
+
+		// Garbage.
+		{token: "garbage", ecode: http.StatusForbidden, ebody: unauthorized},
+
+		// Expired and revoked keys.
+		{token: expired, ecode: http.StatusForbidden, ebody: unauthorized},
+		{token: revoked, ecode: http.StatusForbidden, ebody: unauthorized},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		var p *Principal
+		handler := RequireAuth(http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+
+			p = PrincipalFromRequest(r)
+			WriteSuccessMessage(c, w, r)
+		}), &APIKeyAuthenticator{Scopes: test.scopes})
+		handler.NewContext = func(r *http.Request) Context { return c }
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/", nil)
+		h.FatalNotNil("creating request", err)
+		if test.token != "" {
+			r.Header.Set(APIKeyHeader, test.token)
+		}
+		handler.ServeHTTP(w, r)
+
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		if test.ecode != http.StatusOK {
+			h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+			continue
+		}
+
+		h.FatalNotEqual("principal", p != nil, true)
+		h.ErrorNotEqual("principal", *p, Principal{ID: "owner@example.com",
+			Method: MethodAPIKey, Scopes: []string{"read"}})
+	}
+
+	// Using the key updates LastUsed.
+	k, ak, err := CheckAPIKey(c, valid)
+	h.FatalNotNil("check", err)
+	h.ErrorNotEqual("last used", ak.LastUsed.IsZero(), false)
+	h.ErrorNotEqual("kind", k.Kind(), APIKeyKind)
+}
+
+func TestAPIKeyRoles(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	err := SetUserRoles(c, "owner@example.com", "editor", "viewer")
+	h.FatalNotNil("set roles", err)
+	_, token, err := IssueAPIKey(c, "owner@example.com", "viewer",
+		[]string{"viewer"}, time.Time{})
+	h.FatalNotNil("issue", err)
+
+	tests := []struct {
+		roles []string
+		ecode int
+	}{
+		// A role the key is scoped to.
+		{roles: []string{"viewer"}, ecode: http.StatusOK},
+
+		// The owner's other roles aren't inherited.
+		{roles: []string{"editor"}, ecode: http.StatusForbidden},
+		{roles: []string{AdminRole}, ecode: http.StatusForbidden},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		handler := RequireAuth(RequireRoles(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				WriteSuccessMessage(c, w, r)
+			}), test.roles...), &APIKeyAuthenticator{})
+		handler.NewContext = func(r *http.Request) Context { return c }
+		handler.Handler.(*RoleHandler).NewContext =
+			func(r *http.Request) Context { return c }
+
+		w := httptest.NewRecorder()
+		r := newRequest("GET", "/", nil)
+		r.Header.Set(APIKeyHeader, token)
+		handler.ServeHTTP(w, r)
+
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	aelog "google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/user"
+	"net/http"
+	"net/url"
+	"reflect"
+)
+
+// appengineContext is a Context that uses the App Engine services.
+type appengineContext struct {
+	context.Context
+}
+
+// NewContext returns a Context for the given request that uses the
+// App Engine services. It is canceled when the request is.
+func NewContext(r *http.Request) Context {
+	return NewAppEngineContext(appengine.NewContext(r))
+}
+
+// contextFor returns the Context a handler should use for the
+// request: the one from newContext or, if it's nil, NewContext.
+func contextFor(newContext func(*http.Request) Context,
+	r *http.Request) Context {
+
+	if newContext != nil {
+		return newContext(r)
+	}
+
+	return NewContext(r)
+}
+
+// NewAppEngineContext returns a Context that uses the App Engine
+// services through the given context, which must come from
+// appengine.NewContext or be derived from one. Its cancellation and
+// deadline apply to all of the datastore calls.
+func NewAppEngineContext(ctx context.Context) Context {
+	return appengineContext{ctx}
+}
+
+// Debugf implements Logger.
+func (c appengineContext) Debugf(format string, args ...interface{}) {
+	aelog.Debugf(c.Context, format, args...)
+}
+
+// Infof implements Logger.
+func (c appengineContext) Infof(format string, args ...interface{}) {
+	aelog.Infof(c.Context, format, args...)
+}
+
+// Warningf implements Logger.
+func (c appengineContext) Warningf(format string, args ...interface{}) {
+	aelog.Warningf(c.Context, format, args...)
+}
+
+// Errorf implements Logger.
+func (c appengineContext) Errorf(format string, args ...interface{}) {
+	aelog.Errorf(c.Context, format, args...)
+}
+
+// Criticalf implements Logger.
+func (c appengineContext) Criticalf(format string, args ...interface{}) {
+	aelog.Criticalf(c.Context, format, args...)
+}
+
+// AllocateIDs implements Datastore.
+func (c appengineContext) AllocateIDs(kind string, parent *datastore.Key,
+	n int) (int64, int64, error) {
+
+	return datastore.AllocateIDs(c.Context, kind, parent, n)
+}
+
+// NewKey implements Datastore.
+func (c appengineContext) NewKey(kind, stringID string, intID int64,
+	parent *datastore.Key) *datastore.Key {
+
+	return datastore.NewKey(c.Context, kind, stringID, intID, parent)
+}
+
+// GetMulti implements Datastore.
+func (c appengineContext) GetMulti(keys []*datastore.Key,
+	dst interface{}) error {
+
+	return datastore.GetMulti(c.Context, keys, dst)
+}
+
+// PutMulti implements Datastore.
+func (c appengineContext) PutMulti(keys []*datastore.Key,
+	src interface{}) ([]*datastore.Key, error) {
+
+	return datastore.PutMulti(c.Context, keys, src)
+}
+
+// DeleteMulti implements Datastore.
+func (c appengineContext) DeleteMulti(keys []*datastore.Key) error {
+	return datastore.DeleteMulti(c.Context, keys)
+}
+
+// GetAll implements Datastore.
+func (c appengineContext) GetAll(q *Query,
+	dst interface{}) ([]*datastore.Key, error) {
+
+	dq, err := toDatastoreQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return dq.GetAll(c.Context, dst)
+}
+
+// GetPage implements Datastore. It asks for one more result than the
+// limit to find out if there is another page.
+func (c appengineContext) GetPage(q *Query,
+	dst interface{}) ([]*datastore.Key, string, error) {
+
+	dq, err := toDatastoreQuery(q)
+	if err != nil {
+		return nil, "", err
+	}
+	if q.Limit > 0 {
+		dq = dq.Limit(q.Limit + 1)
+	}
+
+	var dv reflect.Value
+	if !q.KeysOnly {
+		dv = reflect.ValueOf(dst)
+		if dv.Kind() != reflect.Ptr || dv.Elem().Kind() != reflect.Slice {
+			return nil, "", datastore.ErrInvalidEntityType
+		}
+		dv = dv.Elem()
+	}
+
+	keys := make([]*datastore.Key, 0)
+	it := dq.Run(c.Context)
+	for q.Limit <= 0 || len(keys) < q.Limit {
+		var key *datastore.Key
+		if q.KeysOnly {
+			key, err = it.Next(nil)
+		} else {
+			ev := reflect.New(dv.Type().Elem()).Elem()
+			key, err = it.Next(entityPointer(ev))
+			if err == nil {
+				dv.Set(reflect.Append(dv, ev))
+			}
+		}
+
+		if err == datastore.Done {
+			return keys, "", nil
+		} else if err != nil {
+			return nil, "", err
+		}
+
+		keys = append(keys, key)
+	}
+
+	// We have a full page, so see if there is anything after it.
+	cursor, err := it.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := it.Next(nil); err == datastore.Done {
+		return keys, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	return keys, cursor.String(), nil
+}
+
+// Run implements Datastore.
+func (c appengineContext) Run(q *Query) (Iterator, error) {
+	dq, err := toDatastoreQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return appengineIterator{dq.Run(c.Context)}, nil
+}
+
+// appengineIterator is an Iterator over a datastore.Iterator.
+type appengineIterator struct {
+	*datastore.Iterator
+}
+
+// Cursor implements Iterator.
+func (it appengineIterator) Cursor() (string, error) {
+	cursor, err := it.Iterator.Cursor()
+	if err != nil {
+		return "", err
+	}
+
+	return cursor.String(), nil
+}
+
+// toDatastoreQuery converts the query into a datastore.Query.
+func toDatastoreQuery(q *Query) (*datastore.Query, error) {
+	dq := datastore.NewQuery(q.Kind)
+	if q.Ancestor != nil {
+		dq = dq.Ancestor(q.Ancestor)
+	}
+	for _, f := range q.Filters {
+		dq = dq.Filter(f.Property+" "+f.Op, f.Value)
+	}
+	for _, o := range q.Orders {
+		dq = dq.Order(o)
+	}
+	if q.KeysOnly {
+		dq = dq.KeysOnly()
+	}
+	if q.Limit > 0 {
+		dq = dq.Limit(q.Limit)
+	}
+	if q.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(q.Cursor)
+		if err != nil {
+			return nil, ErrBadCursor.Wrap(err)
+		}
+		dq = dq.Start(cursor)
+	}
+
+	return dq, nil
+}
+
+// entityPointer returns a pointer to the entity in the given slice
+// element, allocating it if the element is a nil pointer.
+func entityPointer(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return v.Interface()
+	}
+
+	return v.Addr().Interface()
+}
+
+// RunInTransaction implements Datastore. Retrying is left to the
+// caller, so the transaction is only attempted once.
+func (c appengineContext) RunInTransaction(fn func(tc Context) error,
+	xg bool) error {
+
+	return datastore.RunInTransaction(c.Context,
+		func(tc context.Context) error {
+			return fn(appengineContext{tc})
+		}, &datastore.TransactionOptions{XG: xg, Attempts: 1})
+}
+
+// AddTask implements TaskQueue.
+func (c appengineContext) AddTask(path string, params url.Values,
+	queue string) error {
+
+	_, err := taskqueue.Add(c.Context, taskqueue.NewPOSTTask(path, params),
+		queue)
+	return err
+}
+
+// CurrentUser implements Users.
+func (c appengineContext) CurrentUser() *user.User {
+	return user.Current(c.Context)
+}
+
+// CurrentOAuthUser implements Users.
+func (c appengineContext) CurrentOAuthUser(scopes ...string) (*user.User,
+	error) {
+
+	return user.CurrentOAuth(c.Context, scopes...)
+}
+
+// LoginURL implements Users.
+func (c appengineContext) LoginURL(dest string) (string, error) {
+	return user.LoginURL(c.Context, dest)
+}
+
+// LogoutURL implements Users.
+func (c appengineContext) LogoutURL(dest string) (string, error) {
+	return user.LogoutURL(c.Context, dest)
+}
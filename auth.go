@@ -0,0 +1,199 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"fmt"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+	"net/http"
+	"sort"
+)
+
+// AdminRole is the role every App Engine administrator has. See
+// user.IsAdmin.
+const AdminRole = "admin"
+
+// RoleKind is the datastore kind of the UserRoles entities.
+var RoleKind string = "UserRoles"
+
+// ErrUnauthenticated is sent when a request needs a user but no one
+// is logged in.
+var ErrUnauthenticated = RegisterError(&Error{
+	Code:     "unauthenticated",
+	Status:   http.StatusUnauthorized,
+	Message:  "You must be logged in to do that.",
+	Severity: "info",
+})
+
+// UserRoles are the roles an application has given a user. They are
+// stored as a RoleKind entity whose key name is the user's email.
+type UserRoles struct {
+	Roles []string
+}
+
+// userRolesKey returns the key of the UserRoles for the email.
+func userRolesKey(c Context, email string) *datastore.Key {
+	return c.NewKey(RoleKind, email, 0, nil)
+}
+
+// GetUserRoles returns the roles stored for the user with the given
+// email. A user without any stored roles has none.
+func GetUserRoles(c Context, email string) ([]string, error) {
+	ur := make([]UserRoles, 1)
+	err := c.GetMulti([]*datastore.Key{userRolesKey(c, email)}, ur)
+	if me, ok := err.(appengine.MultiError); ok &&
+		me[0] == datastore.ErrNoSuchEntity {
+
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return ur[0].Roles, nil
+}
+
+// SetUserRoles stores the roles for the user with the given email,
+// replacing any they had. The AdminRole doesn't need to be stored.
+func SetUserRoles(c Context, email string, roles ...string) error {
+	roles = append([]string{}, roles...)
+	sort.Strings(roles)
+
+	_, err := c.PutMulti([]*datastore.Key{userRolesKey(c, email)},
+		[]*UserRoles{&UserRoles{Roles: roles}})
+	return err
+}
+
+// HasRoles returns true if the user has all of the given roles. The
+// AdminRole comes from the user itself and the rest from their
+// UserRoles.
+func HasRoles(c Context, u *user.User, roles ...string) (bool, error) {
+	return hasRoles(c, u.Email, u.Admin, roles)
+}
+
+// hasRoles returns true if the user whose roles are stored under the
+// given name has all of the roles.
+func hasRoles(c Context, name string, admin bool,
+	roles []string) (bool, error) {
+
+	var stored map[string]bool
+	for _, role := range roles {
+		if role == AdminRole {
+			if !admin {
+				return false, nil
+			}
+			continue
+		}
+
+		// Only look up the stored roles if we need them.
+		if stored == nil {
+			sroles, err := GetUserRoles(c, name)
+			if err != nil {
+				return false, err
+			}
+
+			stored = make(map[string]bool)
+			for _, sr := range sroles {
+				stored[sr] = true
+			}
+		}
+
+		if !stored[role] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// checkRoles returns the current principal (see currentPrincipal) if
+// they have all of the roles. A principal authenticated with an API key
+// only has the roles that are also among the key's scopes. Otherwise,
+// it returns the error to send: an ErrUnauthenticated if no one is
+// logged in or an ErrUnauthorized if they lack a role.
+func checkRoles(c Context, r *http.Request, roles []string) (*user.User,
+	error) {
+
+	p := currentPrincipal(c, r)
+	if p == nil {
+		return nil, ErrUnauthenticated.Wrap(fmt.Errorf("no user found, "+
+			"but roles %v are required", roles))
+	}
+
+	// API keys only get the roles of their owner they were scoped to.
+	if p.Method == MethodAPIKey && !hasScopes(p.Scopes, roles) {
+		return nil, ErrUnauthorized.Wrap(fmt.Errorf("api key of %s "+
+			"isn't scoped to roles %v", p.name(), roles))
+	}
+
+	ok, err := hasRoles(c, p.name(), p.Admin, roles)
+	if err != nil {
+		return nil, DatastoreError(err)
+	}
+	if !ok {
+		return nil, ErrUnauthorized.Wrap(fmt.Errorf("%s doesn't have "+
+			"roles %v", p.name(), roles))
+	}
+
+	return p.User(), nil
+}
+
+// RequireRolesOrFail fetches the request's principal (see
+// AuthHandler) or the currently logged in user and makes sure they
+// have all of the given roles (see HasRoles). The bool
+// returned determines if they do. If not, a 401 is sent if no one is
+// logged in and a 403 "unauthorized" message if they lack a role.
+// That case should terminate your response processing.
+func RequireRolesOrFail(c Context, w http.ResponseWriter,
+	r *http.Request, roles ...string) (*user.User, bool) {
+
+	u, err := checkRoles(c, r, roles)
+	if err != nil {
+		LogAndError(c, w, r, err)
+		return nil, false
+	}
+
+	return u, true
+}
+
+// AuthorizeRoles returns a Resource Authorize hook that only allows
+// users with all of the given roles.
+func AuthorizeRoles(roles ...string) func(c Context, r *http.Request,
+	key *datastore.Key) error {
+
+	return func(c Context, r *http.Request, key *datastore.Key) error {
+		_, err := checkRoles(c, r, roles)
+		return err
+	}
+}
+
+// RoleHandler is middleware that only lets users with all of Roles
+// through to Handler. Everyone else gets the responses sent by
+// RequireRolesOrFail.
+type RoleHandler struct {
+	Handler http.Handler
+	Roles   []string
+
+	// NewContext makes the Context for a request. If it is nil, the
+	// package NewContext is used.
+	NewContext func(r *http.Request) Context
+}
+
+// RequireRoles returns a RoleHandler for the handler and roles.
+func RequireRoles(h http.Handler, roles ...string) *RoleHandler {
+	return &RoleHandler{Handler: h, Roles: roles}
+}
+
+// ServeHTTP implements http.Handler.
+func (rh *RoleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := contextFor(rh.NewContext, r)
+
+	if _, ok := RequireRolesOrFail(c, w, r, rh.Roles...); !ok {
+		return
+	}
+
+	rh.Handler.ServeHTTP(w, r)
+}
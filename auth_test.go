@@ -0,0 +1,115 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"github.com/icub3d/gorca/internal/testhelper"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireRoles(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	err := SetUserRoles(c, "editor@example.com", "editor", "viewer")
+	h.FatalNotNil("set roles", err)
+
+	roles, err := GetUserRoles(c, "editor@example.com")
+	h.FatalNotNil("get roles", err)
+	h.ErrorNotEqual("roles", roles, []string{"editor", "viewer"})
+
+	tests := []struct {
+		email string
+		admin bool
+		roles []string
+		ecode int
+		ebody string
+	}{
+		// No one is logged in.
+		{
+			roles: []string{"viewer"},
+			ecode: http.StatusUnauthorized,
+			ebody: `{"Type":"error","Message":"You must be logged in to do that."}`,
+		},
+
+		// Anyone logged in.
+		{
+			email: "nobody@example.com",
+			ecode: http.StatusOK,
+		},
+
+		// Stored roles.
+		{
+			email: "editor@example.com",
+			roles: []string{"editor", "viewer"},
+			ecode: http.StatusOK,
+		},
+
+		// A missing role.
+		{
+			email: "editor@example.com",
+			roles: []string{"editor", "owner"},
+			ecode: http.StatusForbidden,
+			ebody: `{"Type":"error","Message":"You are not authorized to do that."}`,
+		},
+
+		// An admin.
+		{
+			email: "admin@example.com",
+			admin: true,
+			roles: []string{AdminRole},
+			ecode: http.StatusOK,
+		},
+
+		// Not an admin.
+		{
+			email: "editor@example.com",
+			roles: []string{AdminRole},
+			ecode: http.StatusForbidden,
+			ebody: `{"Type":"error","Message":"You are not authorized to do that."}`,
+		},
+
+		// Admins still need the stored roles.
+		{
+			email: "admin@example.com",
+			admin: true,
+			roles: []string{AdminRole, "editor"},
+			ecode: http.StatusForbidden,
+			ebody: `{"Type":"error","Message":"You are not authorized to do that."}`,
+		},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		c.Logout()
+		if test.email != "" {
+			c.Login(test.email, test.admin)
+		}
+
+		handler := RequireRoles(http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+
+			WriteSuccessMessage(c, w, r)
+		}), test.roles...)
+		handler.NewContext = func(r *http.Request) Context { return c }
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/", nil)
+		h.FatalNotNil("creating request", err)
+		handler.ServeHTTP(w, r)
+
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		if test.ecode != http.StatusOK {
+			h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+		}
+
+		// The Resource hook should agree.
+		err = AuthorizeRoles(test.roles...)(c, r, nil)
+		h.ErrorNotEqual("authorize", err == nil, test.ecode == http.StatusOK)
+	}
+}
@@ -0,0 +1,456 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/appengine/user"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AuthRealm is the realm given in the WWW-Authenticate challenges. If
+// it is empty, no realm is given.
+var AuthRealm string = ""
+
+// These are the methods a Principal can be authenticated with.
+const (
+	MethodOAuth  = "oauth"
+	MethodJWT    = "jwt"
+	MethodCookie = "cookie"
+)
+
+// Principal is who a request was made by, however they were
+// authenticated.
+type Principal struct {
+	// ID identifies the principal: the user ID or the JWT subject.
+	ID string
+
+	// Email is the principal's email, if it is known.
+	Email string
+
+	// Admin is true for App Engine administrators.
+	Admin bool
+
+	// Method is how they were authenticated (e.g. MethodOAuth).
+	Method string
+
+	// Scopes are the scopes their credentials were granted.
+	Scopes []string
+
+	// Claims are the claims in their JWT, if they used one.
+	Claims map[string]interface{}
+}
+
+// User returns the principal as an App Engine user.
+func (p *Principal) User() *user.User {
+	return &user.User{Email: p.Email, ID: p.ID, Admin: p.Admin}
+}
+
+// name returns what the principal's roles and entities are stored
+// under. JWT principals are known by their subject, prefixed with
+// MethodJWT so a token can't pass for a user with that email or ID.
+// Others are known by their email or, without one, their ID.
+func (p *Principal) name() string {
+	if p.Method == MethodJWT {
+		return MethodJWT + ":" + p.ID
+	}
+	if p.Email != "" {
+		return p.Email
+	}
+	return p.ID
+}
+
+// Authenticator finds the principal for a request's credentials.
+type Authenticator interface {
+	// Authenticate returns the principal for the request. If the
+	// request doesn't have the kind of credentials it checks, nil is
+	// returned without an error. If they are invalid, an error is
+	// returned.
+	Authenticate(c Context, r *http.Request) (*Principal, error)
+
+	// Challenge returns the WWW-Authenticate challenge sent when
+	// authentication fails or "" if there isn't one.
+	Challenge() string
+}
+
+// hasScopes returns true if all of the required scopes were granted.
+func hasScopes(granted, required []string) bool {
+	have := make(map[string]bool)
+	for _, s := range granted {
+		have[s] = true
+	}
+	for _, s := range required {
+		if !have[s] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bearerToken returns the token in the request's Authorization header
+// or "" if it doesn't have a bearer token.
+func bearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return ""
+	}
+
+	return strings.TrimSpace(parts[1])
+}
+
+// bearerChallenge returns a Bearer challenge with the AuthRealm and
+// the given params.
+func bearerChallenge(params ...string) string {
+	if AuthRealm != "" {
+		params = append([]string{fmt.Sprintf("realm=%q", AuthRealm)},
+			params...)
+	}
+	if len(params) == 0 {
+		return "Bearer"
+	}
+
+	return "Bearer " + strings.Join(params, ", ")
+}
+
+// OAuthAuthenticator authenticates requests with an OAuth bearer
+// token using the Context's CurrentOAuthUser.
+type OAuthAuthenticator struct {
+	// Scopes are the scopes the token must have been granted.
+	Scopes []string
+}
+
+// Authenticate implements Authenticator. Tokens that aren't valid
+// OAuth tokens are left for the other authenticators, since they may
+// be a JWT.
+func (a *OAuthAuthenticator) Authenticate(c Context,
+	r *http.Request) (*Principal, error) {
+
+	if bearerToken(r) == "" {
+		return nil, nil
+	}
+
+	u, err := c.CurrentOAuthUser(a.Scopes...)
+	if err != nil || u == nil {
+		return nil, nil
+	}
+
+	return &Principal{
+		ID:     u.ID,
+		Email:  u.Email,
+		Admin:  u.Admin,
+		Method: MethodOAuth,
+		Scopes: a.Scopes,
+	}, nil
+}
+
+// Challenge implements Authenticator.
+func (a *OAuthAuthenticator) Challenge() string {
+	if len(a.Scopes) == 0 {
+		return bearerChallenge()
+	}
+
+	return bearerChallenge(fmt.Sprintf("scope=%q",
+		strings.Join(a.Scopes, " ")))
+}
+
+// JWTAuthenticator authenticates requests with a signed JWT bearer
+// token. The principal's ID is the "sub" claim, their email is the
+// "email" claim if the "email_verified" claim is true, and their
+// scopes are the space separated "scope" claim. Their roles and
+// entities are found by their ID, not their email. Tokens must have
+// an "exp" claim and can't be used before their "iat" or "nbf"
+// claims.
+type JWTAuthenticator struct {
+	// Keys are the keys the tokens are verified with by their "kid"
+	// header. Tokens without a "kid" use the "" key. HMAC keys are a
+	// []byte, RSA keys a *rsa.PublicKey, and ECDSA keys a
+	// *ecdsa.PublicKey.
+	Keys map[string]interface{}
+
+	// Methods are the signing methods accepted (e.g. "RS256"). If it
+	// is empty, any method the key works with is accepted.
+	Methods []string
+
+	// Issuer and Audience are the "iss" and "aud" claims required, if
+	// they are set.
+	Issuer   string
+	Audience string
+
+	// Leeway is how much clock skew is allowed when checking the
+	// expiration and issue times.
+	Leeway time.Duration
+
+	// AllowNoExpiration accepts tokens without an "exp" claim. They
+	// never expire, so it should only be set for tokens that are
+	// revoked some other way.
+	AllowNoExpiration bool
+}
+
+// Authenticate implements Authenticator. Bearer tokens that aren't
+// shaped like a JWT are left for the other authenticators.
+func (a *JWTAuthenticator) Authenticate(c Context,
+	r *http.Request) (*Principal, error) {
+
+	token := bearerToken(r)
+	if strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+
+	opts := []jwt.ParserOption{jwt.WithLeeway(a.Leeway), jwt.WithIssuedAt()}
+	if !a.AllowNoExpiration {
+		opts = append(opts, jwt.WithExpirationRequired())
+	}
+	if len(a.Methods) > 0 {
+		opts = append(opts, jwt.WithValidMethods(a.Methods))
+	}
+	if a.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.Issuer))
+	}
+	if a.Audience != "" {
+		opts = append(opts, jwt.WithAudience(a.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims,
+		func(t *jwt.Token) (interface{}, error) {
+			kid, _ := t.Header["kid"].(string)
+			key, ok := a.Keys[kid]
+			if !ok {
+				return nil, fmt.Errorf("unknown key %q", kid)
+			}
+			return key, nil
+		}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := claims.GetSubject()
+	if err != nil || sub == "" {
+		return nil, errors.New("token has no subject")
+	}
+	email := ""
+	if verified, _ := claims["email_verified"].(bool); verified {
+		email, _ = claims["email"].(string)
+	}
+	scope, _ := claims["scope"].(string)
+
+	return &Principal{
+		ID:     sub,
+		Email:  email,
+		Method: MethodJWT,
+		Scopes: strings.Fields(scope),
+		Claims: claims,
+	}, nil
+}
+
+// Challenge implements Authenticator.
+func (a *JWTAuthenticator) Challenge() string {
+	return bearerChallenge()
+}
+
+// CookieAuthenticator authenticates requests with the user logged in
+// with a cookie (see Context.CurrentUser). Requests with an
+// Authorization header are left for the other authenticators.
+type CookieAuthenticator struct{}
+
+// Authenticate implements Authenticator.
+func (a CookieAuthenticator) Authenticate(c Context,
+	r *http.Request) (*Principal, error) {
+
+	if r.Header.Get("Authorization") != "" {
+		return nil, nil
+	}
+
+	u := c.CurrentUser()
+	if u == nil {
+		return nil, nil
+	}
+
+	return &Principal{
+		ID:     u.ID,
+		Email:  u.Email,
+		Admin:  u.Admin,
+		Method: MethodCookie,
+	}, nil
+}
+
+// Challenge implements Authenticator.
+func (a CookieAuthenticator) Challenge() string {
+	return ""
+}
+
+// AuthChain tries each of its authenticators in order.
+type AuthChain []Authenticator
+
+// DefaultAuthChain tries OAuth and then the cookie user. JWTs need
+// keys, so add a JWTAuthenticator to your own chain to accept them.
+var DefaultAuthChain = AuthChain{&OAuthAuthenticator{},
+	CookieAuthenticator{}}
+
+// Authenticate implements Authenticator. The first principal found is
+// returned. If an authenticator finds invalid credentials, it stops
+// with the error. Credentials in an Authorization header that none of
+// the authenticators accept are an error as well.
+func (ac AuthChain) Authenticate(c Context, r *http.Request) (*Principal,
+	error) {
+
+	for _, a := range ac {
+		p, err := a.Authenticate(c, r)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			return p, nil
+		}
+	}
+
+	if r.Header.Get("Authorization") != "" {
+		return nil, errors.New("credentials not accepted")
+	}
+
+	return nil, nil
+}
+
+// Challenge implements Authenticator. It returns the challenges of
+// its authenticators, without duplicates, separated by commas.
+func (ac AuthChain) Challenge() string {
+	return strings.Join(ac.challenges(false), ", ")
+}
+
+// challenges returns the distinct challenges of the authenticators.
+// If invalid is true, Bearer challenges say the token is invalid.
+func (ac AuthChain) challenges(invalid bool) []string {
+	seen := make(map[string]bool)
+	var challenges []string
+	for _, a := range ac {
+		ch := a.Challenge()
+		if ch == "" || seen[ch] {
+			continue
+		}
+		seen[ch] = true
+
+		if invalid && strings.HasPrefix(ch, "Bearer") {
+			if ch == "Bearer" {
+				ch += " "
+			} else {
+				ch += ", "
+			}
+			ch += `error="invalid_token"`
+		}
+		challenges = append(challenges, ch)
+	}
+
+	return challenges
+}
+
+// AuthenticateOrFail finds the principal for the request with the
+// given chain. If chain is nil, the DefaultAuthChain is used. The
+// bool returned determines if one was found. If not, a 401
+// "unauthenticated" message is sent with the WWW-Authenticate
+// challenges of the chain. Authenticators that fail with one of the
+// registered errors (e.g. ErrUnauthorized) get that error sent
+// instead. That case should terminate your response processing.
+func AuthenticateOrFail(c Context, w http.ResponseWriter, r *http.Request,
+	chain AuthChain) (*Principal, bool) {
+
+	if chain == nil {
+		chain = DefaultAuthChain
+	}
+
+	p, err := chain.Authenticate(c, r)
+	if err == nil && p != nil {
+		return p, true
+	}
+
+	invalid := err != nil
+	var e *Error
+	if !errors.As(err, &e) {
+		if err == nil {
+			err = errors.New("no credentials")
+		}
+		e = ErrUnauthenticated.Wrap(fmt.Errorf("authenticating: %s", err))
+	}
+
+	if e.Status == http.StatusUnauthorized {
+		for _, ch := range chain.challenges(invalid) {
+			w.Header().Add("WWW-Authenticate", ch)
+		}
+	}
+
+	LogAndError(c, w, r, e)
+	return nil, false
+}
+
+// principalKey is the request context key of the Principal.
+type principalKey struct{}
+
+// WithPrincipal returns a copy of the request with the principal in
+// its context.
+func WithPrincipal(r *http.Request, p *Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// PrincipalFromRequest returns the principal put in the request by
+// WithPrincipal or an AuthHandler. If there isn't one, nil is
+// returned.
+func PrincipalFromRequest(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey{}).(*Principal)
+	return p
+}
+
+// currentPrincipal returns the request's principal (see
+// PrincipalFromRequest) or, without one, the currently logged in
+// user. If there is neither, nil is returned.
+func currentPrincipal(c Context, r *http.Request) *Principal {
+	if p := PrincipalFromRequest(r); p != nil {
+		return p
+	}
+
+	u := c.CurrentUser()
+	if u == nil {
+		return nil
+	}
+
+	return &Principal{ID: u.ID, Email: u.Email, Admin: u.Admin,
+		Method: MethodCookie}
+}
+
+// AuthHandler is middleware that authenticates requests with Chain
+// and passes them to Handler with the principal in them (see
+// PrincipalFromRequest). Everyone else gets the responses sent by
+// AuthenticateOrFail. The role checks in this package use the
+// principal instead of the cookie user.
+type AuthHandler struct {
+	Handler http.Handler
+	Chain   AuthChain
+
+	// NewContext makes the Context for a request. If it is nil, the
+	// package NewContext is used.
+	NewContext func(r *http.Request) Context
+}
+
+// RequireAuth returns an AuthHandler for the handler and
+// authenticators. Without any, the DefaultAuthChain is used.
+func RequireAuth(h http.Handler, chain ...Authenticator) *AuthHandler {
+	return &AuthHandler{Handler: h, Chain: chain}
+}
+
+// ServeHTTP implements http.Handler.
+func (ah *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := contextFor(ah.NewContext, r)
+
+	p, ok := AuthenticateOrFail(c, w, r, ah.Chain)
+	if !ok {
+		return
+	}
+
+	ah.Handler.ServeHTTP(w, WithPrincipal(r, p))
+}
@@ -0,0 +1,276 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/icub3d/gorca/internal/testhelper"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	h := testhelper.New(t)
+
+	key := []byte("secret")
+	sign := func(claims jwt.MapClaims, kid string, key []byte) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		s, err := token.SignedString(key)
+		h.FatalNotNil("signing", err)
+		return s
+	}
+	valid := sign(jwt.MapClaims{
+		"sub":            "123",
+		"email":          "jwt@example.com",
+		"email_verified": true,
+		"scope":          "read write",
+		"iss":            "issuer",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	}, "k1", key)
+	unverified := sign(jwt.MapClaims{
+		"sub":   "123",
+		"email": "cookie@example.com",
+		"iss":   "issuer",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}, "k1", key)
+	expired := sign(jwt.MapClaims{
+		"sub": "123",
+		"iss": "issuer",
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	}, "k1", key)
+	noExpiration := sign(jwt.MapClaims{"sub": "123", "iss": "issuer"}, "k1",
+		key)
+	future := sign(jwt.MapClaims{
+		"sub": "123",
+		"iss": "issuer",
+		"iat": time.Now().Add(time.Hour).Unix(),
+		"exp": time.Now().Add(2 * time.Hour).Unix(),
+	}, "k1", key)
+	wrongKey := sign(jwt.MapClaims{"sub": "123", "iss": "issuer"}, "k1",
+		[]byte("other"))
+	unknownKid := sign(jwt.MapClaims{"sub": "123", "iss": "issuer"}, "k2",
+		key)
+
+	AuthRealm = "test"
+	defer func() { AuthRealm = "" }()
+
+	chain := AuthChain{
+		&OAuthAuthenticator{Scopes: []string{"email"}},
+		&JWTAuthenticator{Keys: map[string]interface{}{"k1": key},
+			Issuer: "issuer"},
+		CookieAuthenticator{},
+	}
+
+	tests := []struct {
+		auth        string
+		cookie      string
+		oauth       string
+		scopes      []string
+		ecode       int
+		emethod     string
+		eemail      string
+		echallenges []string
+	}{
+		// No credentials.
+		{
+			ecode: http.StatusUnauthorized,
+			echallenges: []string{
+				`Bearer realm="test", scope="email"`,
+				`Bearer realm="test"`,
+			},
+		},
+
+		// The cookie user.
+		{
+			cookie:  "cookie@example.com",
+			ecode:   http.StatusOK,
+			emethod: MethodCookie,
+			eemail:  "cookie@example.com",
+		},
+
+		// OAuth.
+		{
+			auth:    "Bearer oauth-token",
+			oauth:   "oauth@example.com",
+			scopes:  []string{"email", "profile"},
+			ecode:   http.StatusOK,
+			emethod: MethodOAuth,
+			eemail:  "oauth@example.com",
+		},
+
+		// OAuth without the scope doesn't fall back to the cookie.
+		{
+			auth:   "Bearer oauth-token",
+			cookie: "cookie@example.com",
+			oauth:  "oauth@example.com",
+			scopes: []string{"profile"},
+			ecode:  http.StatusUnauthorized,
+			echallenges: []string{
+				`Bearer realm="test", scope="email", error="invalid_token"`,
+				`Bearer realm="test", error="invalid_token"`,
+			},
+		},
+
+		// A valid JWT.
+		{
+			auth:    "Bearer " + valid,
+			ecode:   http.StatusOK,
+			emethod: MethodJWT,
+			eemail:  "jwt@example.com",
+		},
+
+		// An email that isn't verified is left out.
+		{
+			auth:    "Bearer " + unverified,
+			ecode:   http.StatusOK,
+			emethod: MethodJWT,
+		},
+
+		// An expired JWT.
+		{
+			auth:  "Bearer " + expired,
+			ecode: http.StatusUnauthorized,
+			echallenges: []string{
+				`Bearer realm="test", scope="email", error="invalid_token"`,
+				`Bearer realm="test", error="invalid_token"`,
+			},
+		},
+
+		// A JWT that never expires.
+		{
+			auth:  "Bearer " + noExpiration,
+			ecode: http.StatusUnauthorized,
+			echallenges: []string{
+				`Bearer realm="test", scope="email", error="invalid_token"`,
+				`Bearer realm="test", error="invalid_token"`,
+			},
+		},
+
+		// A JWT issued in the future.
+		{
+			auth:  "Bearer " + future,
+			ecode: http.StatusUnauthorized,
+			echallenges: []string{
+				`Bearer realm="test", scope="email", error="invalid_token"`,
+				`Bearer realm="test", error="invalid_token"`,
+			},
+		},
+
+		// A JWT signed with the wrong key.
+		{
+			auth:  "Bearer " + wrongKey,
+			ecode: http.StatusUnauthorized,
+			echallenges: []string{
+				`Bearer realm="test", scope="email", error="invalid_token"`,
+				`Bearer realm="test", error="invalid_token"`,
+			},
+		},
+
+		// A JWT with a key we don't have.
+		{
+			auth:  "Bearer " + unknownKid,
+			ecode: http.StatusUnauthorized,
+			echallenges: []string{
+				`Bearer realm="test", scope="email", error="invalid_token"`,
+				`Bearer realm="test", error="invalid_token"`,
+			},
+		},
+
+		// Some other scheme.
+		{
+			auth:   "Basic dXNlcjpwYXNz",
+			cookie: "cookie@example.com",
+			ecode:  http.StatusUnauthorized,
+			echallenges: []string{
+				`Bearer realm="test", scope="email", error="invalid_token"`,
+				`Bearer realm="test", error="invalid_token"`,
+			},
+		},
+	}
+
+	c := NewStandaloneContext()
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		c.Logout()
+		if test.cookie != "" {
+			c.Login(test.cookie, false)
+		}
+		if test.oauth != "" {
+			c.LoginOAuth(test.oauth, false, test.scopes...)
+		}
+
+		var p *Principal
+		handler := RequireAuth(http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+
+			p = PrincipalFromRequest(r)
+			WriteSuccessMessage(c, w, r)
+		}), chain...)
+		handler.NewContext = func(r *http.Request) Context { return c }
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/", nil)
+		h.FatalNotNil("creating request", err)
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		handler.ServeHTTP(w, r)
+
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		h.ErrorNotEqual("challenges", w.Header()["Www-Authenticate"],
+			test.echallenges)
+		if test.ecode != http.StatusOK {
+			h.ErrorNotEqual("response body", w.Body.String(),
+				`{"Type":"error","Message":"You must be logged in to do that."}`)
+			continue
+		}
+
+		h.FatalNotEqual("principal", p != nil, true)
+		h.ErrorNotEqual("method", p.Method, test.emethod)
+		h.ErrorNotEqual("email", p.Email, test.eemail)
+	}
+}
+
+func TestPrincipalRoles(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	err := SetUserRoles(c, "jwt:123", "editor")
+	h.FatalNotNil("set roles", err)
+	err = SetUserRoles(c, "cookie@example.com", "owner")
+	h.FatalNotNil("set cookie roles", err)
+
+	// The principal is used instead of the cookie user.
+	c.Login("cookie@example.com", false)
+
+	r, err := http.NewRequest("GET", "/", nil)
+	h.FatalNotNil("creating request", err)
+	r = WithPrincipal(r, &Principal{ID: "123", Email: "jwt@example.com",
+		Method: MethodJWT})
+
+	w := httptest.NewRecorder()
+	u, ok := RequireRolesOrFail(c, w, r, "editor")
+	h.FatalNotEqual("require roles", ok, true)
+	h.ErrorNotEqual("user", u.Email, "jwt@example.com")
+
+	w = httptest.NewRecorder()
+	_, ok = RequireRolesOrFail(c, w, r, "owner")
+	h.ErrorNotEqual("require missing role", ok, false)
+	h.ErrorNotEqual("response code", w.Code, http.StatusForbidden)
+
+	// A JWT with someone else's email doesn't get their roles.
+	r = WithPrincipal(r, &Principal{ID: "456", Email: "cookie@example.com",
+		Method: MethodJWT})
+	w = httptest.NewRecorder()
+	_, ok = RequireRolesOrFail(c, w, r, "owner")
+	h.ErrorNotEqual("require their role", ok, false)
+	h.ErrorNotEqual("response code", w.Code, http.StatusForbidden)
+}
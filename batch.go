@@ -0,0 +1,144 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"fmt"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"reflect"
+	"sync"
+)
+
+// MaxBatchSize is the most entities PutKeys and DeleteKeys send to
+// the datastore in a single call. Larger slices are split into
+// batches of this size. It is the datastore's limit for a single
+// PutMulti or DeleteMulti.
+var MaxBatchSize = 500
+
+// MaxBatchWorkers is the most batches PutKeys and DeleteKeys send to
+// the datastore at the same time.
+var MaxBatchWorkers = 4
+
+// batch is the range of keys [low, high) in a single call to the
+// datastore.
+type batch struct {
+	low, high int
+}
+
+// batches splits n keys into batches of at most MaxBatchSize.
+func batches(n int) []batch {
+	size := MaxBatchSize
+	if size <= 0 {
+		size = n
+	}
+
+	var b []batch
+	for low := 0; low < n; low += size {
+		high := low + size
+		if high > n {
+			high = n
+		}
+		b = append(b, batch{low, high})
+	}
+
+	return b
+}
+
+// runBatches calls f for each of the batches, running at most
+// MaxBatchWorkers at a time. If any of them fail, an
+// appengine.MultiError with an error for each of the n keys is
+// returned. The errors of a batch that failed as a whole are given to
+// all of its keys.
+func runBatches(n int, f func(b batch) error) error {
+	workers := MaxBatchWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		me     = make(appengine.MultiError, n)
+		failed bool
+		sem    = make(chan struct{}, workers)
+	)
+
+	for _, b := range batches(n) {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(b batch) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := f(b)
+			if err == nil {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			failed = true
+			if bme, ok := err.(appengine.MultiError); ok &&
+				len(bme) == b.high-b.low {
+
+				copy(me[b.low:b.high], bme)
+				return
+			}
+			for x := b.low; x < b.high; x++ {
+				me[x] = err
+			}
+		}(b)
+	}
+	wg.Wait()
+
+	if failed {
+		return me
+	}
+
+	return nil
+}
+
+// putMulti is a PutMulti split into batches. See runBatches.
+func putMulti(c Context, keys []*datastore.Key,
+	src interface{}) ([]*datastore.Key, error) {
+
+	if len(keys) <= MaxBatchSize || MaxBatchSize <= 0 {
+		return c.PutMulti(keys, src)
+	}
+
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return nil, fmt.Errorf("putting %d keys: src must be a slice "+
+			"of the same length", len(keys))
+	}
+
+	ret := make([]*datastore.Key, len(keys))
+	err := runBatches(len(keys), func(b batch) error {
+		bkeys, err := c.PutMulti(keys[b.low:b.high],
+			v.Slice(b.low, b.high).Interface())
+		if err == nil {
+			copy(ret[b.low:b.high], bkeys)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// deleteMulti is a DeleteMulti split into batches. See runBatches.
+func deleteMulti(c Context, keys []*datastore.Key) error {
+	if len(keys) <= MaxBatchSize || MaxBatchSize <= 0 {
+		return c.DeleteMulti(keys)
+	}
+
+	return runBatches(len(keys), func(b batch) error {
+		return c.DeleteMulti(keys[b.low:b.high])
+	})
+}
@@ -0,0 +1,94 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"github.com/icub3d/gorca/internal/testhelper"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBatches(t *testing.T) {
+	h := testhelper.New(t)
+
+	defer func(size int) { MaxBatchSize = size }(MaxBatchSize)
+	MaxBatchSize = 2
+
+	tests := []struct {
+		n        int
+		expected []batch
+	}{
+		{n: 0},
+		{n: 1, expected: []batch{{0, 1}}},
+		{n: 2, expected: []batch{{0, 2}}},
+		{n: 5, expected: []batch{{0, 2}, {2, 4}, {4, 5}}},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+		h.ErrorNotEqual("batches", batches(test.n), test.expected)
+	}
+}
+
+func TestPutAndDeleteKeysBatched(t *testing.T) {
+	h := testhelper.New(t)
+
+	defer func(size, workers int) {
+		MaxBatchSize, MaxBatchWorkers = size, workers
+	}(MaxBatchSize, MaxBatchWorkers)
+	MaxBatchSize, MaxBatchWorkers = 2, 2
+
+	c := NewStandaloneContext()
+	r, err := http.NewRequest("POST", "/batch", nil)
+	h.FatalNotNil("creating request", err)
+
+	keys := make([]*datastore.Key, 0, 5)
+	items := make([]*standaloneItem, 0, 5)
+	for x := 0; x < 5; x++ {
+		keys = append(keys, c.NewKey("Item", "", int64(x+1), nil))
+		items = append(items, &standaloneItem{"batch", int64(x)})
+	}
+
+	// Put them all and make sure they are there.
+	w := httptest.NewRecorder()
+	h.FatalNotEqual("put keys", PutKeys(c, w, r, keys, items), true)
+
+	found := make([]standaloneItem, 5)
+	h.FatalNotNil("get multi", c.GetMulti(keys, found))
+	for x, item := range found {
+		h.ErrorNotEqual("found", item, standaloneItem{"batch", int64(x)})
+	}
+
+	// A bad key should only fail its own batch.
+	bad := append([]*datastore.Key{}, keys...)
+	bad[3] = nil
+	err = deleteMulti(c, bad)
+	me, ok := err.(appengine.MultiError)
+	h.FatalNotEqual("multi error", ok, true)
+	h.FatalNotEqual("errors", len(me), 5)
+	for x, e := range me {
+		h.ErrorNotEqual("failed", e != nil, x == 2 || x == 3)
+	}
+
+	err = c.GetMulti(keys, found)
+	me, ok = err.(appengine.MultiError)
+	h.FatalNotEqual("multi error", ok, true)
+	for x, e := range me {
+		h.ErrorNotEqual("deleted", e == datastore.ErrNoSuchEntity,
+			x != 2 && x != 3)
+	}
+
+	// The whole request fails.
+	w = httptest.NewRecorder()
+	h.ErrorNotEqual("delete keys", DeleteKeys(c, w, r, bad), false)
+	h.ErrorNotEqual("response code", w.Code, http.StatusBadRequest)
+
+	// Deleting the rest works.
+	w = httptest.NewRecorder()
+	h.ErrorNotEqual("delete keys", DeleteKeys(c, w, r, keys), true)
+}
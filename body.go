@@ -0,0 +1,119 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// MaxBodySize is the most bytes read from a request body. Larger
+// bodies are rejected with an ErrTooLarge. If it is zero or less,
+// bodies are not limited.
+var MaxBodySize int64 = 10 << 20
+
+// StrictJSON makes JSON bodies with fields that don't exist in the
+// value being decoded into fail to decode. Bodies with data after the
+// JSON value always fail.
+var StrictJSON bool = false
+
+// ErrTooLarge is sent when a request body is larger than
+// MaxBodySize.
+var ErrTooLarge = RegisterError(&Error{
+	Code:     "toolarge",
+	Status:   http.StatusRequestEntityTooLarge,
+	Message:  "Request too large.",
+	Severity: "warn",
+})
+
+// limitBody limits the request body to MaxBodySize. If the request
+// says it is larger, false is returned and a response was returned
+// to the request.
+func limitBody(c Context, w http.ResponseWriter, r *http.Request) bool {
+	if MaxBodySize <= 0 {
+		return true
+	}
+
+	if r.ContentLength > MaxBodySize {
+		LogAndError(c, w, r, ErrTooLarge.Wrap(fmt.Errorf(
+			"content length %d is over %d", r.ContentLength, MaxBodySize)))
+		return false
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxBodySize)
+	return true
+}
+
+// isTooLarge returns true if the error came from reading past
+// MaxBodySize.
+func isTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+// decodeJSON reads a single JSON value from the reader into v
+// following the StrictJSON setting.
+func decodeJSON(rd io.Reader, v interface{}) error {
+	dec := json.NewDecoder(rd)
+	if StrictJSON {
+		dec.DisallowUnknownFields()
+	}
+
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	// Like json.Unmarshal, anything but whitespace after the value
+	// is an error.
+	_, err := dec.Token()
+	switch err {
+	case io.EOF:
+		return nil
+	case nil:
+		return fmt.Errorf("json: data after the top-level value")
+	}
+
+	return err
+}
+
+// unmarshalJSON is a Decoder for JSON that follows the StrictJSON
+// setting.
+func unmarshalJSON(data []byte, v interface{}) error {
+	return decodeJSON(bytes.NewReader(data), v)
+}
+
+// DecodeJSONBodyOrFail attempts to decode the JSON request body into
+// the given interface as it is read, without buffering the whole
+// body. The result is then validated (see ValidateOrFail). Bodies
+// over MaxBodySize are rejected with a 413. If another error occurs,
+// the failure is logged and a generic message is returned as the
+// response. The boolean value returned signifies the success of the
+// operation. In either case, this should be terminal.
+func DecodeJSONBodyOrFail(c Context, w http.ResponseWriter,
+	r *http.Request, v interface{}) bool {
+
+	if r.Body == nil {
+		LogAndFailed(c, w, r, fmt.Errorf("no body found"))
+		return false
+	}
+	if !limitBody(c, w, r) {
+		return false
+	}
+
+	if err := decodeJSON(r.Body, v); err != nil {
+		if isTooLarge(err) {
+			LogAndError(c, w, r, ErrTooLarge.Wrap(err))
+		} else {
+			LogAndFailed(c, w, r, err)
+		}
+		return false
+	}
+
+	return ValidateOrFail(c, w, r, v)
+}
@@ -0,0 +1,161 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"github.com/icub3d/gorca/internal/testhelper"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSONBodyOrFail(t *testing.T) {
+	h := testhelper.New(t)
+
+	defer func(size int64, strict bool) {
+		MaxBodySize, StrictJSON = size, strict
+	}(MaxBodySize, StrictJSON)
+	MaxBodySize = 32
+
+	tests := []struct {
+		body    string
+		strict  bool
+		chunked bool
+		result  bool
+		ecode   int
+		ebody   string
+	}{
+		// A normal body.
+		{
+			body:   `{"C":123}`,
+			result: true,
+		},
+
+		// Unknown fields are ignored.
+		{
+			body:   `{"C":123,"D":1}`,
+			result: true,
+		},
+
+		// Unless we are strict.
+		{
+			body:   `{"C":123,"D":1}`,
+			strict: true,
+			ecode:  http.StatusBadRequest,
+			ebody:  `{"Type":"error","Message":"Failed."}`,
+		},
+
+		// Trailing whitespace is fine.
+		{
+			body:   "{\"C\":123}\n",
+			strict: true,
+			result: true,
+		},
+
+		// Trailing data is not.
+		{
+			body:  `{"C":123}{"C":456}`,
+			ecode: http.StatusBadRequest,
+			ebody: `{"Type":"error","Message":"Failed."}`,
+		},
+
+		// Nor is bad JSON.
+		{
+			body:  `{"C":12`,
+			ecode: http.StatusBadRequest,
+			ebody: `{"Type":"error","Message":"Failed."}`,
+		},
+
+		// A body that says it is too large.
+		{
+			body:  `{"C":123,"Padding":"` + strings.Repeat("x", 32) + `"}`,
+			ecode: http.StatusRequestEntityTooLarge,
+			ebody: `{"Type":"error","Message":"Request too large."}`,
+		},
+
+		// A body that turns out to be too large.
+		{
+			body:    `{"C":123,"Padding":"` + strings.Repeat("x", 32) + `"}`,
+			chunked: true,
+			ecode:   http.StatusRequestEntityTooLarge,
+			ebody:   `{"Type":"error","Message":"Request too large."}`,
+		},
+	}
+
+	c := NewStandaloneContext()
+
+	for k, test := range tests {
+		h.SetIndex(k)
+		StrictJSON = test.strict
+
+		var body io.Reader = strings.NewReader(test.body)
+		if test.chunked {
+			// Hide the length.
+			body = io.MultiReader(body)
+		}
+		r, err := http.NewRequest("POST", "/", body)
+		h.FatalNotNil("creating request", err)
+		w := httptest.NewRecorder()
+
+		var v struct{ C int64 }
+		result := DecodeJSONBodyOrFail(c, w, r, &v)
+		h.ErrorNotEqual("result", result, test.result)
+		if test.result {
+			h.ErrorNotEqual("decoded", v.C, int64(123))
+			continue
+		}
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+	}
+}
+
+func TestGetBodyOrFailTooLarge(t *testing.T) {
+	h := testhelper.New(t)
+
+	defer func(size int64) { MaxBodySize = size }(MaxBodySize)
+	MaxBodySize = 4
+
+	c := NewStandaloneContext()
+
+	tests := []struct {
+		body   io.Reader
+		result bool
+		ecode  int
+	}{
+		// Just small enough.
+		{
+			body:   strings.NewReader("1234"),
+			result: true,
+		},
+
+		// A known length.
+		{
+			body:  strings.NewReader("12345"),
+			ecode: http.StatusRequestEntityTooLarge,
+		},
+
+		// An unknown length.
+		{
+			body:  io.MultiReader(strings.NewReader("12345")),
+			ecode: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		r, err := http.NewRequest("POST", "/", test.body)
+		h.FatalNotNil("creating request", err)
+		w := httptest.NewRecorder()
+
+		_, result := GetBodyOrFail(c, w, r)
+		h.ErrorNotEqual("result", result, test.result)
+		if !test.result {
+			h.ErrorNotEqual("response code", w.Code, test.ecode)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"errors"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"net/url"
+)
+
+// taskQueueHeader names the queue of a task request. App Engine sets
+// it on task requests and strips it from external ones.
+const taskQueueHeader = "X-AppEngine-QueueName"
+
+// standaloneTaskKey is the request context key under which
+// StandaloneContext.RunTasks puts the state of the context running
+// the task.
+type standaloneTaskKey struct{}
+
+// fromTaskQueue returns true if the request is a task from the task
+// queue of c. On App Engine, that's known by the taskQueueHeader,
+// which is stripped from external requests. Elsewhere anyone can set
+// the header, so only the requests made by StandaloneContext.RunTasks
+// are tasks.
+func fromTaskQueue(c Context, r *http.Request) bool {
+	if r.Header.Get(taskQueueHeader) == "" {
+		return false
+	}
+
+	switch c := c.(type) {
+	case appengineContext:
+		return true
+	case *StandaloneContext:
+		state := r.Context().Value(standaloneTaskKey{})
+		return state == c.state
+	}
+
+	return false
+}
+
+// CascadeDeleteKey is a helper function that removes the given key
+// and all of its descendants, whatever their kind, from the
+// datastore. The descendants are found and deleted MaxBatchSize at a
+// time. If a failure occured, false is returned and a response was
+// returned to the request. This case should be terminal. For entity
+// groups too large to delete during a request, use
+// QueueCascadeDelete.
+func CascadeDeleteKey(c Context, w http.ResponseWriter,
+	r *http.Request, key *datastore.Key) bool {
+
+	if err := cascadeDelete(c, key); err != nil {
+		LogAndError(c, w, r, DatastoreError(err))
+		return false
+	}
+
+	return true
+}
+
+// cascadeDelete deletes the key and its descendants.
+func cascadeDelete(c Context, key *datastore.Key) error {
+	limit := MaxBatchSize
+	if limit <= 0 {
+		limit = 500
+	}
+
+	// The key is one of its own ancestors, so it is found as well.
+	// Every page is deleted before the next query, so we simply
+	// query until nothing is left.
+	q := &Query{Ancestor: key, KeysOnly: true, Limit: limit}
+	for {
+		keys, _, err := c.GetPage(q, nil)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+
+		if err := deleteMulti(c, keys); err != nil {
+			return err
+		}
+	}
+}
+
+// QueueCascadeDelete is a helper function that queues a task to
+// remove the given key and all of its descendants. The task POSTs
+// the encoded key as the "key" form value to path, which should be
+// served by HandleCascadeDelete. If queue is empty, the default queue
+// is used. If a failure occured, false is returned and a response was
+// returned to the request. This case should be terminal. Otherwise,
+// the handler should respond with WriteAcceptedMessage.
+func QueueCascadeDelete(c Context, w http.ResponseWriter,
+	r *http.Request, key *datastore.Key, path, queue string) bool {
+
+	params := url.Values{"key": {key.Encode()}}
+	if err := c.AddTask(path, params, queue); err != nil {
+		LogAndUnexpected(c, w, r, err)
+		return false
+	}
+
+	return true
+}
+
+// HandleCascadeDelete serves the tasks queued by QueueCascadeDelete.
+// It deletes the key in the "key" form value and its descendants and
+// responds with a success message. Requests that didn't come from the
+// task queue get a 403, so outside clients can't delete entity
+// groups. On App Engine, tasks are known by their
+// X-AppEngine-QueueName header. With a StandaloneContext, where any
+// client could send that header, only the tasks run by its RunTasks
+// are served. A malformed key is logged and answered with success,
+// since retrying it would never work. On other failures, an error is
+// sent so the task is retried.
+func HandleCascadeDelete(c Context, w http.ResponseWriter,
+	r *http.Request) {
+
+	if !fromTaskQueue(c, r) {
+		LogAndError(c, w, r, ErrUnauthorized.Wrap(
+			errors.New("cascade delete not from the task queue")))
+		return
+	}
+
+	key, err := datastore.DecodeKey(r.FormValue("key"))
+	if err != nil {
+		Log(c, r, "error", "dropping cascade delete of %q: %v",
+			r.FormValue("key"), err)
+		WriteSuccessMessage(c, w, r)
+		return
+	}
+
+	if !CascadeDeleteKey(c, w, r, key) {
+		return
+	}
+
+	WriteSuccessMessage(c, w, r)
+}
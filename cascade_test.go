@@ -0,0 +1,138 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"github.com/icub3d/gorca/internal/testhelper"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// putCascadeGroup saves an entity group of several kinds as well as
+// an unrelated entity. It returns the root, the rest of the group,
+// and the unrelated key.
+func putCascadeGroup(c Context) (*datastore.Key, []*datastore.Key,
+	*datastore.Key, error) {
+
+	root := c.NewKey("List", "root", 0, nil)
+	item := c.NewKey("Item", "", 1, root)
+	note := c.NewKey("Note", "", 2, item)
+	tag := c.NewKey("Tag", "", 3, root)
+	other := c.NewKey("List", "other", 0, nil)
+
+	keys := []*datastore.Key{root, item, note, tag, other}
+	values := make([]*standaloneItem, len(keys))
+	for x := range values {
+		values[x] = &standaloneItem{"cascade", int64(x)}
+	}
+	if _, err := c.PutMulti(keys, values); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return root, []*datastore.Key{item, note, tag}, other, nil
+}
+
+// checkCascadeGroup makes sure the group is gone but the unrelated
+// entity is not.
+func checkCascadeGroup(t *testing.T, c Context, root *datastore.Key,
+	group []*datastore.Key, other *datastore.Key) {
+
+	keys := append([]*datastore.Key{root}, group...)
+	for _, key := range keys {
+		err := c.GetMulti([]*datastore.Key{key}, make([]standaloneItem, 1))
+		if err == nil {
+			t.Errorf("%v was not deleted", key)
+		}
+	}
+
+	err := c.GetMulti([]*datastore.Key{other}, make([]standaloneItem, 1))
+	if err != nil {
+		t.Errorf("%v was deleted: %v", other, err)
+	}
+}
+
+func TestCascadeDeleteKey(t *testing.T) {
+	h := testhelper.New(t)
+
+	defer func(size int) { MaxBatchSize = size }(MaxBatchSize)
+	MaxBatchSize = 2
+
+	c := NewStandaloneContext()
+	root, group, other, err := putCascadeGroup(c)
+	h.FatalNotNil("putting group", err)
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("DELETE", "/lists/root", nil)
+	h.FatalNotNil("creating request", err)
+
+	h.ErrorNotEqual("cascade delete", CascadeDeleteKey(c, w, r, root), true)
+	h.ErrorNotEqual("response code", w.Code, http.StatusOK)
+	checkCascadeGroup(t, c, root, group, other)
+}
+
+func TestQueueCascadeDelete(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	root, group, other, err := putCascadeGroup(c)
+	h.FatalNotNil("putting group", err)
+
+	// Queue the delete.
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("DELETE", "/lists/root", nil)
+	h.FatalNotNil("creating request", err)
+
+	ok := QueueCascadeDelete(c, w, r, root, "/tasks/delete", "")
+	h.FatalNotEqual("queue cascade delete", ok, true)
+	WriteAcceptedMessage(c, w, r)
+	h.ErrorNotEqual("response code", w.Code, http.StatusAccepted)
+	h.ErrorNotEqual("response body", w.Body.String(),
+		`{"Type":"success","Message":"Accepted."}`)
+
+	tasks := c.Tasks()
+	h.FatalNotEqual("tasks", len(tasks), 1)
+	h.ErrorNotEqual("task path", tasks[0].Path, "/tasks/delete")
+	h.ErrorNotEqual("task key", tasks[0].Params.Get("key"), root.Encode())
+
+	// Nothing should be deleted until the task is run.
+	err = c.GetMulti([]*datastore.Key{root}, make([]standaloneItem, 1))
+	h.ErrorNotNil("before task", err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		HandleCascadeDelete(c, w, r)
+	})
+
+	// Requests from outside the task queue are refused.
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newTypedRequest("POST", "/tasks/delete",
+		"application/x-www-form-urlencoded", "key="+root.Encode()))
+	h.ErrorNotEqual("external response code", w.Code, http.StatusForbidden)
+	err = c.GetMulti([]*datastore.Key{root}, make([]standaloneItem, 1))
+	h.ErrorNotNil("after external request", err)
+
+	// Outside of App Engine, the header can be forged.
+	r = newTypedRequest("POST", "/tasks/delete",
+		"application/x-www-form-urlencoded", "key="+root.Encode())
+	r.Header.Set(taskQueueHeader, "default")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	h.ErrorNotEqual("forged response code", w.Code, http.StatusForbidden)
+	err = c.GetMulti([]*datastore.Key{root}, make([]standaloneItem, 1))
+	h.ErrorNotNil("after forged request", err)
+
+	h.FatalNotNil("running tasks", c.RunTasks(handler))
+	h.ErrorNotEqual("tasks left", len(c.Tasks()), 0)
+	checkCascadeGroup(t, c, root, group, other)
+
+	// A bad key is dropped rather than retried forever.
+	err = c.AddTask("/tasks/delete", nil, "")
+	h.FatalNotNil("adding task", err)
+	h.ErrorNotNil("running bad task", c.RunTasks(handler))
+	h.ErrorNotEqual("tasks left", len(c.Tasks()), 0)
+}
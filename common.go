@@ -5,80 +5,90 @@
 // Package gorca contains common RESTful structures, methods, and
 // functions that are useful go appengine applications.
 //
-// If you are testing these functions, there are some steps you need
-// to do to setup a proper testing environment. 
+// The helpers take a Context, which is a context.Context backed by
+// the google.golang.org/appengine packages. Use NewContext to run
+// them against the App Engine services and NewStandaloneContext to
+// run them in plain net/http services or in unit tests.
+//
+// The tests use a StandaloneContext, so they need no App Engine SDK:
 //
-//    export APPENGINE_SDK=/path/to/google_appengine
-//    cd $GOPATH/src
-//    ln -s $APPENGINE_SDK/goroot/src/pkg/appengine
-//    ln -s $APPENGINE_SDK/goroot/src/pkg/appengine_internal
-//    go get github.com/icub3d/appenginetesting
 //    cd github.com/icub3d/gorca
 //    go test ./...
 package gorca
 
 import (
-	"appengine"
 	"fmt"
 	"net/http"
 )
 
-// Message is a basic JSON response.
+// Message is a basic JSON response. Fields lists the invalid fields
+// when the request failed validation. Version is the current version
+// of the entity when a versioned put conflicted.
 type Message struct {
 	Type    string
 	Message string
+	Fields  []FieldError `json:",omitempty"`
+	Version *int64       `json:",omitempty"`
 }
 
-// ErrMsgs contains common JSON response messages.
-var ErrMsgs map[string]string = map[string]string{
-	"failed":       "Failed.",
-	"notfound":     "Not found.",
-	"success":      "Success.",
-	"unexpected":   "Something unexpected happened.",
-	"unauthorized": "You are not authorized to do that.",
-}
+// SuccessMessage is the message sent by WriteSuccessMessage. The
+// error messages are part of the registered errors (see Error).
+var SuccessMessage string = "Success."
+
+// AcceptedMessage is the message sent by WriteAcceptedMessage.
+var AcceptedMessage string = "Accepted."
 
 // NotFoundFunc makes a http.HandlerFunc that returns a standard
 // 404 not found as well as a JSON response with the error.
 func NotFoundFunc(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
+	c := NewContext(r)
 
 	LogAndNotFound(c, w, r, fmt.Errorf("not found func"))
 }
 
 // LogAndNotFound logs the given error message and returns a not found
-// JSON error message as well as a 404.
-func LogAndNotFound(c appengine.Context, w http.ResponseWriter,
+// JSON error message as well as a 404 (see ErrNotFound).
+func LogAndNotFound(c Context, w http.ResponseWriter,
 	r *http.Request, err error) {
 
-	err = fmt.Errorf("not found: %v", err)
-	LogAndMessage(c, w, r, err, "error", ErrMsgs["notfound"],
-		http.StatusNotFound)
+	LogAndError(c, w, r, ErrNotFound.Wrap(err))
 }
 
 // LogAndFailed logs the given error message and returns a failed
-// JSON error message as well as a 400.
-func LogAndFailed(c appengine.Context, w http.ResponseWriter,
+// JSON error message as well as a 400 (see ErrFailed).
+func LogAndFailed(c Context, w http.ResponseWriter,
 	r *http.Request, err error) {
 
-	err = fmt.Errorf("failed: %v", err)
-	LogAndMessage(c, w, r, err, "error", ErrMsgs["failed"],
-		http.StatusBadRequest)
+	LogAndError(c, w, r, ErrFailed.Wrap(err))
 }
 
 // LogAndUnexpected logs the given error message and returns an
-// internal server error JSON error message as well as a 500.
-func LogAndUnexpected(c appengine.Context, w http.ResponseWriter,
+// internal server error JSON error message as well as a 500 (see
+// ErrUnexpected).
+func LogAndUnexpected(c Context, w http.ResponseWriter,
 	r *http.Request, err error) {
 
-	err = fmt.Errorf("unexpected: %v", err)
-	LogAndMessage(c, w, r, err, "error", ErrMsgs["unexpected"],
-		http.StatusInternalServerError)
+	LogAndError(c, w, r, ErrUnexpected.Wrap(err))
+}
+
+// LogAndError logs the given error with the severity of the error
+// FindError returns for it and then sends that error as the
+// response.
+func LogAndError(c Context, w http.ResponseWriter, r *http.Request,
+	err error) {
+
+	e := FindError(err)
+	if err != nil {
+		Log(c, r, e.Severity, "%v", err)
+	}
+	Log(c, r, "info", "sent response (%s): %s", "error", e.Message)
+
+	writeError(c, w, r, e)
 }
 
 // LogAndMessage logs the given error (if it is not nil) then sends
 // the given JSON message and status as the response.
-func LogAndMessage(c appengine.Context, w http.ResponseWriter,
+func LogAndMessage(c Context, w http.ResponseWriter,
 	r *http.Request, err error, mtype, message string, code int) {
 
 	if err != nil {
@@ -5,16 +5,14 @@
 package gorca
 
 import (
-	"appengine"
 	"fmt"
-	"github.com/icub3d/appenginetesting"
-	"github.com/icub3d/testhelper"
+	"github.com/icub3d/gorca/internal/testhelper"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 )
 
-type LogAndFunc func(c appengine.Context, w http.ResponseWriter,
+type LogAndFunc func(c Context, w http.ResponseWriter,
 	r *http.Request, err error)
 
 func TestLogAnds(t *testing.T) {
@@ -65,9 +63,7 @@ func TestLogAnds(t *testing.T) {
 	}
 
 	// We are going to reuse the context.
-	c, err := appenginetesting.NewContext(nil)
-	h.FatalNotNil("creating contxt", err)
-	defer c.Close()
+	c := NewStandaloneContext()
 
 	for i, test := range tests {
 		h.SetIndex(i)
@@ -113,9 +109,7 @@ func TestLogAndMessage(t *testing.T) {
 	}
 
 	// We are going to reuse the context.
-	c, err := appenginetesting.NewContext(nil)
-	h.FatalNotNil("creating context", err)
-	defer c.Close()
+	c := NewStandaloneContext()
 
 	for i, test := range tests {
 		h.SetIndex(i)
@@ -0,0 +1,143 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Compression turns on gzip and deflate compression of the responses
+// sent by WriteJSON, WriteData, WriteMessage and the error helpers
+// for requests whose Accept-Encoding allows it. App Engine compresses
+// responses itself, so this is mostly useful elsewhere.
+var Compression bool = false
+
+// CompressionThreshold is the smallest response body, in bytes, that
+// is compressed when Compression is on.
+var CompressionThreshold int = 1024
+
+// compressors are the supported content encodings in the order they
+// are preferred.
+var compressors = []struct {
+	name   string
+	writer func(w io.Writer) io.WriteCloser
+}{
+	{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+	{"deflate", func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }},
+}
+
+// writeResponse sends the headers with the given status code and then
+// the body, compressing it if Compression is on and the request
+// accepts it. A strong ETag gets the content encoding added to it
+// since the compressed body is different.
+func writeResponse(c Context, w http.ResponseWriter, r *http.Request,
+	body []byte, code int) {
+
+	if Compression && len(body) > 0 {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if len(body) >= CompressionThreshold &&
+			w.Header().Get("Content-Encoding") == "" {
+
+			if b, name, ok := compress(body,
+				r.Header.Get("Accept-Encoding")); ok {
+
+				body = b
+				w.Header().Set("Content-Encoding", name)
+				w.Header().Del("Content-Length")
+
+				etag := w.Header().Get("ETag")
+				if strings.HasPrefix(etag, `"`) {
+					w.Header().Set("ETag",
+						strings.TrimSuffix(etag, `"`)+"-"+name+`"`)
+				}
+			}
+		}
+	}
+
+	w.WriteHeader(code)
+	WriteResponse(c, w, r, body)
+}
+
+// compress compresses the body with the encoding the Accept-Encoding
+// header prefers. If it accepts none of them, or compressing doesn't
+// make the body smaller, false is returned.
+func compress(body []byte, accept string) ([]byte, string, bool) {
+	qs := parseAcceptEncoding(accept)
+
+	best, bestq := -1, 0.0
+	for x, comp := range compressors {
+		q, ok := qs[comp.name]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > bestq {
+			best, bestq = x, q
+		}
+	}
+	if best < 0 {
+		return nil, "", false
+	}
+
+	var buf bytes.Buffer
+	cw := compressors[best].writer(&buf)
+	if _, err := cw.Write(body); err != nil {
+		return nil, "", false
+	}
+	if err := cw.Close(); err != nil {
+		return nil, "", false
+	}
+	if buf.Len() >= len(body) {
+		return nil, "", false
+	}
+
+	return buf.Bytes(), compressors[best].name, true
+}
+
+// parseAcceptEncoding returns the quality of each of the codings in
+// an Accept-Encoding header.
+func parseAcceptEncoding(accept string) map[string]float64 {
+	qs := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				var err error
+				if q, err = strconv.ParseFloat(kv[1], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+
+		qs[coding] = q
+	}
+
+	return qs
+}
+
+// trimETagEncoding removes the content encoding writeResponse adds to
+// an ETag.
+func trimETagEncoding(etag string) string {
+	for _, comp := range compressors {
+		if strings.HasSuffix(etag, "-"+comp.name+`"`) {
+			return strings.TrimSuffix(etag, "-"+comp.name+`"`) + `"`
+		}
+	}
+
+	return etag
+}
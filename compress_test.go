@@ -0,0 +1,156 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"github.com/icub3d/gorca/internal/testhelper"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	h := testhelper.New(t)
+
+	defer func(compression, etags bool, threshold int) {
+		Compression, ETags, CompressionThreshold = compression, etags,
+			threshold
+	}(Compression, ETags, CompressionThreshold)
+	CompressionThreshold = 64
+
+	large := Message{Type: "success", Message: strings.Repeat("hello ", 50)}
+	small := Message{Type: "success", Message: "hello"}
+
+	tests := []struct {
+		compression    bool
+		etags          bool
+		data           Message
+		acceptEncoding string
+		ifNoneMatch    string
+		ecode          int
+		eencoding      string
+		evary          []string
+	}{
+		// Compression is off.
+		{
+			data:           large,
+			acceptEncoding: "gzip",
+			ecode:          http.StatusOK,
+			evary:          []string{"Accept"},
+		},
+
+		// Gzip.
+		{
+			compression:    true,
+			data:           large,
+			acceptEncoding: "gzip, deflate",
+			ecode:          http.StatusOK,
+			eencoding:      "gzip",
+			evary:          []string{"Accept", "Accept-Encoding"},
+		},
+
+		// Deflate.
+		{
+			compression:    true,
+			data:           large,
+			acceptEncoding: "gzip;q=0, deflate;q=0.5",
+			ecode:          http.StatusOK,
+			eencoding:      "deflate",
+			evary:          []string{"Accept", "Accept-Encoding"},
+		},
+
+		// Anything.
+		{
+			compression:    true,
+			data:           large,
+			acceptEncoding: "*",
+			ecode:          http.StatusOK,
+			eencoding:      "gzip",
+			evary:          []string{"Accept", "Accept-Encoding"},
+		},
+
+		// Nothing we have.
+		{
+			compression:    true,
+			data:           large,
+			acceptEncoding: "br",
+			ecode:          http.StatusOK,
+			evary:          []string{"Accept", "Accept-Encoding"},
+		},
+
+		// Too small.
+		{
+			compression:    true,
+			data:           small,
+			acceptEncoding: "gzip",
+			ecode:          http.StatusOK,
+			evary:          []string{"Accept", "Accept-Encoding"},
+		},
+
+		// The ETag of a compressed response still matches.
+		{
+			compression:    true,
+			etags:          true,
+			data:           large,
+			acceptEncoding: "gzip",
+			ifNoneMatch:    "gzip",
+			ecode:          http.StatusNotModified,
+			evary:          []string{"Accept", "Accept-Encoding"},
+		},
+	}
+
+	c := NewStandaloneContext()
+
+	for k, test := range tests {
+		h.SetIndex(k)
+		Compression, ETags = test.compression, test.etags
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/", nil)
+		h.FatalNotNil("creating request", err)
+		r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		if test.ifNoneMatch != "" {
+			// Get the ETag for the encoding first.
+			WriteData(c, w, r, test.data)
+			r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+			h.ErrorNotEqual("etag", strings.HasSuffix(
+				w.Header().Get("ETag"), "-"+test.ifNoneMatch+`"`), true)
+			w = httptest.NewRecorder()
+		}
+
+		WriteData(c, w, r, test.data)
+
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		h.ErrorNotEqual("content encoding",
+			w.Header().Get("Content-Encoding"), test.eencoding)
+		h.ErrorNotEqual("vary", w.Header()["Vary"], test.evary)
+		if test.ecode != http.StatusOK {
+			continue
+		}
+
+		// Make sure the body decodes back to what was sent.
+		var body io.Reader = w.Body
+		switch test.eencoding {
+		case "gzip":
+			body, err = gzip.NewReader(body)
+		case "deflate":
+			body, err = zlib.NewReader(body)
+		}
+		h.FatalNotNil("decompressing", err)
+
+		b, err := ioutil.ReadAll(body)
+		h.FatalNotNil("reading", err)
+
+		expected, err := json.Marshal(test.data)
+		h.FatalNotNil("marshal", err)
+		h.ErrorNotEqual("body", string(b), string(expected))
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+	"net/url"
+)
+
+// Context is the environment the gorca helpers run in. It is a
+// context.Context that also logs messages, talks to the datastore,
+// queues tasks, and looks up the current user. Its cancellation and
+// deadline apply to the datastore calls the helpers make. Use
+// NewContext for requests served by App Engine and
+// NewStandaloneContext for plain net/http services and unit tests.
+type Context interface {
+	context.Context
+	Logger
+	Datastore
+	TaskQueue
+	Users
+}
+
+// Logger logs formatted messages at the App Engine priorities.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	Criticalf(format string, args ...interface{})
+}
+
+// Datastore is the part of the datastore the gorca helpers use.
+type Datastore interface {
+	// AllocateIDs returns a range of n integer IDs for the given
+	// kind and parent.
+	AllocateIDs(kind string, parent *datastore.Key, n int) (int64, int64, error)
+
+	// NewKey creates a new key. See datastore.NewKey.
+	NewKey(kind, stringID string, intID int64,
+		parent *datastore.Key) *datastore.Key
+
+	// GetMulti loads the entities for the given keys into dst.
+	GetMulti(keys []*datastore.Key, dst interface{}) error
+
+	// PutMulti saves the entities in src under the given keys.
+	PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.Key, error)
+
+	// DeleteMulti removes the entities for the given keys.
+	DeleteMulti(keys []*datastore.Key) error
+
+	// GetAll runs the query and appends the results to dst. The
+	// keys of the results are returned.
+	GetAll(q *Query, dst interface{}) ([]*datastore.Key, error)
+
+	// GetPage is like GetAll but also returns the cursor where the
+	// next page of results starts. The cursor is empty if there are
+	// no more results.
+	GetPage(q *Query, dst interface{}) ([]*datastore.Key, string, error)
+
+	// Run runs the query and returns an Iterator over its results.
+	Run(q *Query) (Iterator, error)
+
+	// RunInTransaction runs fn once in a transaction. The datastore
+	// calls fn makes through tc are part of the transaction. If fn
+	// returns an error, the transaction is rolled back and the error
+	// is returned. If the commit collides with another transaction,
+	// datastore.ErrConcurrentTransaction is returned. If xg is true,
+	// the transaction may use entities from more than one entity
+	// group.
+	RunInTransaction(fn func(tc Context) error, xg bool) error
+}
+
+// Iterator is the result of a query run with Datastore.Run.
+type Iterator interface {
+	// Next loads the next result into dst, which must be a pointer
+	// to a struct (or nil for a keys only query), and returns its
+	// key. datastore.Done is returned when there are no more
+	// results.
+	Next(dst interface{}) (*datastore.Key, error)
+
+	// Cursor returns the cursor for the position after the last
+	// result returned by Next.
+	Cursor() (string, error)
+}
+
+// TaskQueue queues work to be done outside of the request.
+type TaskQueue interface {
+	// AddTask queues a task that POSTs the given form params to the
+	// given path. If queue is empty, the default queue is used.
+	AddTask(path string, params url.Values, queue string) error
+}
+
+// Users looks up the currently logged in user.
+type Users interface {
+	// CurrentUser returns the logged in user or nil if no one is
+	// logged in.
+	CurrentUser() *user.User
+
+	// CurrentOAuthUser returns the user the request's OAuth token was
+	// granted for. It fails if there is no valid token or it wasn't
+	// granted all of the scopes.
+	CurrentOAuthUser(scopes ...string) (*user.User, error)
+
+	// LoginURL returns a URL that has the user log in and then
+	// redirects them to dest.
+	LoginURL(dest string) (string, error)
+
+	// LogoutURL returns a URL that logs the user out and then
+	// redirects them to dest.
+	LogoutURL(dest string) (string, error)
+}
+
+// Query describes a datastore query in a way every Context can run.
+type Query struct {
+	// Kind is the kind of the entities to find. If it is empty, the
+	// entities of every kind are found. Such kindless queries can
+	// only have an Ancestor and KeysOnly.
+	Kind string
+
+	// Ancestor, if not nil, limits the results to the ancestor and
+	// its descendants.
+	Ancestor *datastore.Key
+
+	// Filters limit the results to the entities whose properties
+	// match all of them.
+	Filters []Filter
+
+	// Orders sorts the results by the given properties. A property
+	// prefixed with a "-" is sorted in descending order.
+	Orders []string
+
+	// KeysOnly only returns the keys of the results.
+	KeysOnly bool
+
+	// Limit, if positive, is the maximum number of results.
+	Limit int
+
+	// Cursor, if not empty, is where the results start. It is a
+	// cursor returned by GetPage.
+	Cursor string
+}
+
+// Filter compares a property of an entity to a value. Op is one of
+// "=", "<", "<=", ">" or ">=".
+type Filter struct {
+	Property string
+	Op       string
+	Value    interface{}
+}
@@ -5,34 +5,98 @@
 package gorca
 
 import (
-	"appengine"
-	"appengine/datastore"
+	"errors"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
 	"net/http"
+	"time"
 )
 
+// These are the errors sent for datastore failures that aren't the
+// server's fault. See DatastoreError.
+var (
+	ErrBadKey = RegisterError(&Error{
+		Code:     "badkey",
+		Status:   http.StatusBadRequest,
+		Message:  "Invalid key.",
+		Severity: "error",
+	}, datastore.ErrInvalidKey)
+
+	ErrBusy = RegisterError(&Error{
+		Code:       "busy",
+		Status:     http.StatusServiceUnavailable,
+		Message:    "Busy. Please try again.",
+		Severity:   "warn",
+		RetryAfter: time.Second,
+	}, datastore.ErrConcurrentTransaction)
+)
+
+func init() {
+	RegisterError(ErrNotFound, datastore.ErrNoSuchEntity)
+	RegisterError(ErrUnexpected, datastore.ErrInvalidEntityType)
+}
+
+// DatastoreError classifies the given datastore error. It returns the
+// registered error (see FindError) that should be sent for it wrapped
+// around err. An appengine.MultiError is classified by its first
+// error. Invalid keys are an ErrBadKey, missing entities an
+// ErrNotFound, and transaction collisions an ErrBusy. Anything else is
+// unexpected.
+func DatastoreError(err error) error {
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+
+	if me, ok := err.(appengine.MultiError); ok {
+		for _, merr := range me {
+			if merr != nil {
+				return FindError(merr).Wrap(err)
+			}
+		}
+	}
+
+	return FindError(err).Wrap(err)
+}
+
 // NewKey is a helper function that allocates a new id and uses it to
 // make a new key. It returns both the string and struct version fo
 // the key. If a failure occured, false is returned and a response was
 // returned to the request. This case should be terminal.
-func NewKey(c appengine.Context, w http.ResponseWriter, r *http.Request,
+func NewKey(c Context, w http.ResponseWriter, r *http.Request,
 	kind string, parent *datastore.Key) (string, *datastore.Key, bool) {
 
 	// Generate a new key for this kind.
-	id, _, err := datastore.AllocateIDs(c, kind, parent, 1)
+	id, _, err := c.AllocateIDs(kind, parent, 1)
 	if err != nil {
-		LogAndUnexpected(c, w, r, err)
+		LogAndError(c, w, r, DatastoreError(err))
 		return "", nil, false
 	}
-	key := datastore.NewKey(c, kind, "", id, parent)
+	key := c.NewKey(kind, "", id, parent)
 
 	return key.Encode(), key, true
 }
 
+// GetKeys is a helper function that performs a GetMulti on the set of
+// keys, loading the entities into dst. If a failure occured, false is
+// returned and a response was returned to the request (a 404 if any
+// of the entities don't exist). This case should be terminal.
+func GetKeys(c Context, w http.ResponseWriter, r *http.Request,
+	keys []*datastore.Key, dst interface{}) bool {
+
+	if err := c.GetMulti(keys, dst); err != nil {
+		LogAndError(c, w, r, DatastoreError(err))
+		return false
+	}
+
+	return true
+}
+
 // PutStringKeys is a helper function that performs a PutMulti on the
 // set of keys and values. If a failure occured, false is returned and
 // a response was returned to the request. This case should be
 // terminal.
-func PutStringKeys(c appengine.Context, w http.ResponseWriter,
+func PutStringKeys(c Context, w http.ResponseWriter,
 	r *http.Request, keys []string, values interface{}) bool {
 
 	dkeys, ok := StringsToKeys(c, w, r, keys)
@@ -44,13 +108,14 @@ func PutStringKeys(c appengine.Context, w http.ResponseWriter,
 }
 
 // PutKeys is a helper function the performs a PutMulti on the set of
-// keys and values. If a failure occured, false is returned and a
-// response was returned to the request. This case should be terminal.
-func PutKeys(c appengine.Context, w http.ResponseWriter, r *http.Request,
+// keys and values. Large sets are put in batches (see MaxBatchSize).
+// If a failure occured, false is returned and a response was returned
+// to the request. This case should be terminal.
+func PutKeys(c Context, w http.ResponseWriter, r *http.Request,
 	keys []*datastore.Key, values interface{}) bool {
 
-	if _, err := datastore.PutMulti(c, keys, values); err != nil {
-		LogAndUnexpected(c, w, r, err)
+	if _, err := putMulti(c, keys, values); err != nil {
+		LogAndError(c, w, r, DatastoreError(err))
 		return false
 	}
 
@@ -61,56 +126,95 @@ func PutKeys(c appengine.Context, w http.ResponseWriter, r *http.Request,
 // key from the datastore as well as all of it's ancestors of the
 // given kind. If a failure occured, false is returned and a response
 // was returned to the request. This case should be terminal.
-func DeleteStringKeyAndAncestors(c appengine.Context, w http.ResponseWriter,
+func DeleteStringKeyAndAncestors(c Context, w http.ResponseWriter,
 	r *http.Request, kind string, key string) bool {
 
-	// Decode the string version of the key.
-	k, err := datastore.DecodeKey(key)
+	k, ok := StringToKey(c, w, r, key)
+	if !ok {
+		return false
+	}
+
+	return DeleteKeyAndAncestors(c, w, r, kind, k)
+}
+
+// DryRunDeleteStringKeyAndAncestors is a helper function that sends
+// the keys DeleteStringKeyAndAncestors would remove without removing
+// them. They are sent as the Keys of a Page. If a failure occured,
+// false is returned and a response was returned to the request. In
+// either case, this should be terminal.
+func DryRunDeleteStringKeyAndAncestors(c Context, w http.ResponseWriter,
+	r *http.Request, kind string, key string) bool {
+
+	k, ok := StringToKey(c, w, r, key)
+	if !ok {
+		return false
+	}
+
+	keys, err := keyAndAncestors(c, kind, k)
 	if err != nil {
-		LogAndUnexpected(c, w, r, err)
+		LogAndError(c, w, r, DatastoreError(err))
 		return false
 	}
 
-	// Call the helper to do the deletions.
-	DeleteKeyAndAncestors(c, w, r, kind, k)
+	skeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		skeys = append(skeys, key.Encode())
+	}
 
+	WriteJSON(c, w, r, Page{Keys: skeys})
 	return true
 }
 
 // DeleteKeyAndAncestors is a helper function that remove the given
 // key from the datastore as well as all of it's ancestors of the
 // given kind. If a failure occured, false is returned and a response
-// was returned to the request. This case should be terminal.
-func DeleteKeyAndAncestors(c appengine.Context, w http.ResponseWriter,
+// was returned to the request. This case should be terminal. To also
+// remove the descendants of other kinds, use CascadeDeleteKey.
+func DeleteKeyAndAncestors(c Context, w http.ResponseWriter,
 	r *http.Request, kind string, key *datastore.Key) bool {
 
-	// Get all of the ancestors.
-	q := datastore.NewQuery(kind).Ancestor(key).KeysOnly()
-	keys, err := q.GetAll(c, nil)
+	keys, err := keyAndAncestors(c, kind, key)
 	if err != nil {
-		LogAndUnexpected(c, w, r, err)
+		LogAndError(c, w, r, DatastoreError(err))
 		return false
 	}
 
-	// Delete all the items and the list.
-	keys = append(keys, key)
-	if !DeleteKeys(c, w, r, keys) {
-		return false
+	return DeleteKeys(c, w, r, keys)
+}
+
+// keyAndAncestors returns the ancestors of the given kind under the
+// key followed by the key itself.
+func keyAndAncestors(c Context, kind string,
+	key *datastore.Key) ([]*datastore.Key, error) {
+
+	q := &Query{Kind: kind, Ancestor: key, KeysOnly: true}
+	found, err := c.GetAll(q, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	return true
+	// The key is found too if it is of the kind.
+	keys := make([]*datastore.Key, 0, len(found)+1)
+	for _, k := range found {
+		if !k.Equal(key) {
+			keys = append(keys, k)
+		}
+	}
+
+	return append(keys, key), nil
 }
 
 // DeleteKeys is a helper function that removes all of the given
-// keys from the datastore. If a failure occured, false is returned
-// and a response was returned to the request. This case should be
+// keys from the datastore. Large sets are deleted in batches (see
+// MaxBatchSize). If a failure occured, false is returned and a
+// response was returned to the request. This case should be
 // terminal.
-func DeleteKeys(c appengine.Context, w http.ResponseWriter,
+func DeleteKeys(c Context, w http.ResponseWriter,
 	r *http.Request, keys []*datastore.Key) bool {
 
 	// Delete all the removed items.
-	if err := datastore.DeleteMulti(c, keys); err != nil {
-		LogAndUnexpected(c, w, r, err)
+	if err := deleteMulti(c, keys); err != nil {
+		LogAndError(c, w, r, DatastoreError(err))
 		return false
 	}
 
@@ -120,8 +224,9 @@ func DeleteKeys(c appengine.Context, w http.ResponseWriter,
 // DeleteStringKeys is a helper function that converts the given
 // strings into datastore keys and then calls DeleteKeyHelper on
 // them. If a failure occured, false is returned and a response was
-// returned to the request. This case should be terminal.
-func DeleteStringKeys(c appengine.Context, w http.ResponseWriter, r *http.Request,
+// returned to the request. This case should be terminal. The keys
+// may belong to anyone; see DeleteOwnedStringKeys.
+func DeleteStringKeys(c Context, w http.ResponseWriter, r *http.Request,
 	keys []string) bool {
 
 	dkeys, ok := StringsToKeys(c, w, r, keys)
@@ -134,13 +239,15 @@ func DeleteStringKeys(c appengine.Context, w http.ResponseWriter, r *http.Reques
 
 // StringToKey is a helper function the turns a string into a
 // datastore key. If a failure occured, false is returned and a
-// response was returned to the request. This case should be terminal.
-func StringToKey(c appengine.Context, w http.ResponseWriter,
+// response was returned to the request (a 400 for a malformed
+// key). This case should be terminal. Any key is decoded, no matter
+// who owns it; see OwnedStringToKey.
+func StringToKey(c Context, w http.ResponseWriter,
 	r *http.Request, key string) (*datastore.Key, bool) {
 
 	k, err := datastore.DecodeKey(key)
 	if err != nil {
-		LogAndUnexpected(c, w, r, err)
+		LogAndError(c, w, r, ErrBadKey.Wrap(err))
 		return nil, false
 	}
 
@@ -151,7 +258,7 @@ func StringToKey(c appengine.Context, w http.ResponseWriter,
 // into a list of datastore keys. If a failure occured, false is
 // returned and a response was returned to the request. This case
 // should be terminal.
-func StringsToKeys(c appengine.Context, w http.ResponseWriter,
+func StringsToKeys(c Context, w http.ResponseWriter,
 	r *http.Request, keys []string) ([]*datastore.Key, bool) {
 
 	dkeys := make([]*datastore.Key, 0, len(keys))
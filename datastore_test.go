@@ -5,10 +5,10 @@
 package gorca
 
 import (
-	"appengine"
-	"appengine/datastore"
-	"github.com/icub3d/appenginetesting"
-	"github.com/icub3d/testhelper"
+	"context"
+	"github.com/icub3d/gorca/internal/testhelper"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -18,9 +18,7 @@ func TestNewKey(t *testing.T) {
 	h := testhelper.New(t)
 
 	// We are going to reuse the context.
-	c, err := appenginetesting.NewContext(nil)
-	h.FatalNotNil("creating contxt", err)
-	defer c.Close()
+	c := NewStandaloneContext()
 
 	// Make the request and writer.
 	w := httptest.NewRecorder()
@@ -44,15 +42,15 @@ func TestPutStringKeys(t *testing.T) {
 	h := testhelper.New(t)
 
 	// We are going to reuse the context.
-	c, err := appenginetesting.NewContext(nil)
-	h.FatalNotNil("creating contxt", err)
-	defer c.Close()
+	c := NewStandaloneContext()
 
 	// These are the tests
 	tests := []struct {
 		keys   []string
 		values []stringer
 		expect bool
+		ecode  int
+		ebody  string
 	}{
 		// An empty list.
 		{
@@ -73,6 +71,8 @@ func TestPutStringKeys(t *testing.T) {
 			keys:   []string{makeKey(c, nil).Encode(), makeKey(c, nil).Encode()},
 			values: []stringer{stringer{"one"}},
 			expect: false,
+			ecode:  http.StatusInternalServerError,
+			ebody:  `{"Type":"error","Message":"Something unexpected happened."}`,
 		},
 
 		// More values than keys.
@@ -80,6 +80,8 @@ func TestPutStringKeys(t *testing.T) {
 			keys:   []string{makeKey(c, nil).Encode(), makeKey(c, nil).Encode()},
 			values: []stringer{stringer{"one"}, stringer{"two"}, stringer{"three"}},
 			expect: false,
+			ecode:  http.StatusInternalServerError,
+			ebody:  `{"Type":"error","Message":"Something unexpected happened."}`,
 		},
 
 		// Invalid key.
@@ -87,6 +89,8 @@ func TestPutStringKeys(t *testing.T) {
 			keys:   []string{makeKey(c, nil).Encode(), makeKey(c, nil).Encode(), "hahaha"},
 			values: []stringer{stringer{"one"}, stringer{"two"}, stringer{"three"}},
 			expect: false,
+			ecode:  http.StatusBadRequest,
+			ebody:  `{"Type":"error","Message":"Invalid key."}`,
 		},
 	}
 
@@ -103,9 +107,8 @@ func TestPutStringKeys(t *testing.T) {
 
 		if test.expect == false {
 			// Test the output.
-			h.ErrorNotEqual("response code", w.Code, http.StatusInternalServerError)
-			h.ErrorNotEqual("response body", w.Body.String(),
-				`{"Type":"error","Message":"Something unexpected happened."}`)
+			h.ErrorNotEqual("response code", w.Code, test.ecode)
+			h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
 		} else {
 			for _, key := range test.keys {
 				// Make sure each of the keys persisted.
@@ -113,7 +116,7 @@ func TestPutStringKeys(t *testing.T) {
 				k, err := datastore.DecodeKey(key)
 				h.FatalNotNil("decoding key", err)
 
-				err = datastore.Get(c, k, &value)
+				err = get(c, k, &value)
 				h.FatalNotNil("datastore get", err)
 
 				// High replication seems to make this impossible.
@@ -129,9 +132,7 @@ func TestDeleteStringKeys(t *testing.T) {
 	h := testhelper.New(t)
 
 	// We are going to reuse the context.
-	c, err := appenginetesting.NewContext(nil)
-	h.FatalNotNil("creating contxt", err)
-	defer c.Close()
+	c := NewStandaloneContext()
 
 	// These are the tests
 	tests := []struct {
@@ -194,7 +195,7 @@ func TestDeleteStringKeys(t *testing.T) {
 			k, err := datastore.DecodeKey(key)
 			h.FatalNotNil("decoding key", err)
 
-			err = datastore.Get(c, k, &value)
+			err = get(c, k, &value)
 			if test.deletes[j] {
 				h.ErrorNil("deleted item", err)
 			} else {
@@ -210,9 +211,7 @@ func TestDeleteStringKeyAndAncestors(t *testing.T) {
 	h := testhelper.New(t)
 
 	// We are going to reuse the context.
-	c, err := appenginetesting.NewContext(nil)
-	h.FatalNotNil("creating contxt", err)
-	defer c.Close()
+	c := NewStandaloneContext()
 
 	// Make the request and writer.
 	w := httptest.NewRecorder()
@@ -235,15 +234,203 @@ func TestDeleteStringKeyAndAncestors(t *testing.T) {
 
 	// Check the parent
 	var value stringer
-	err = datastore.Get(c, parent, &value)
+	err = get(c, parent, &value)
 	h.ErrorNil("deleted parent", err)
 
 	// Check the child
-	err = datastore.Get(c, child, &value)
+	err = get(c, child, &value)
 	h.ErrorNil("deleted child", err)
 }
 
-func makeKey(c appengine.Context, parent *datastore.Key) *datastore.Key {
-	id, _, _ := datastore.AllocateIDs(c, "Item", parent, 1)
-	return datastore.NewKey(c, "Item", "", id, parent)
+func TestDeleteStringKeyAndAncestorsFailures(t *testing.T) {
+	h := testhelper.New(t)
+
+	tests := []struct {
+		key      string
+		canceled bool
+		ecode    int
+		ebody    string
+	}{
+		// A bad key.
+		{
+			key:   "bad",
+			ecode: http.StatusBadRequest,
+			ebody: `{"Type":"error","Message":"Invalid key."}`,
+		},
+
+		// The datastore fails.
+		{
+			canceled: true,
+			ecode:    http.StatusInternalServerError,
+			ebody:    `{"Type":"error","Message":"Something unexpected happened."}`,
+		},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		c := NewStandaloneContext().WithContext(ctx)
+		key := test.key
+		if key == "" {
+			key = makeKey(c, nil).Encode()
+		}
+		if test.canceled {
+			cancel()
+		}
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("DELETE", "/datastore", nil)
+		h.FatalNotNil("creating request", err)
+
+		ok := DeleteStringKeyAndAncestors(c, w, r, "Item", key)
+		cancel()
+
+		// Only the error should be written.
+		h.ErrorNotEqual("delete ancestors", ok, false)
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+	}
+}
+
+func TestDryRunDeleteStringKeyAndAncestors(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+
+	// Make a parent with a child of the kind and one of another kind.
+	parent := makeKey(c, nil)
+	child := makeKey(c, parent)
+	other := c.NewKey("Other", "", 1, parent)
+	_, err := c.PutMulti([]*datastore.Key{parent, child, other},
+		[]stringer{stringer{"parent"}, stringer{"child"}, stringer{"other"}})
+	h.FatalNotNil("put", err)
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("DELETE", "/datastore?dryrun=1", nil)
+	h.FatalNotNil("creating request", err)
+
+	ok := DryRunDeleteStringKeyAndAncestors(c, w, r, "Item", parent.Encode())
+	h.FatalNotEqual("dry run", ok, true)
+	h.ErrorNotEqual("response code", w.Code, http.StatusOK)
+	h.ErrorNotEqual("response body", w.Body.String(),
+		`{"Keys":["`+child.Encode()+`","`+parent.Encode()+`"]}`)
+
+	// Nothing should have been deleted.
+	var value stringer
+	h.ErrorNotNil("parent", get(c, parent, &value))
+	h.ErrorNotNil("child", get(c, child, &value))
+
+	// A bad key.
+	w = httptest.NewRecorder()
+	ok = DryRunDeleteStringKeyAndAncestors(c, w, r, "Item", "bad")
+	h.ErrorNotEqual("bad key", ok, false)
+	h.ErrorNotEqual("response code", w.Code, http.StatusBadRequest)
+}
+
+func makeKey(c Context, parent *datastore.Key) *datastore.Key {
+	id, _, _ := c.AllocateIDs("Item", parent, 1)
+	return c.NewKey("Item", "", id, parent)
+}
+
+// get is a helper function that loads a single stringer from the
+// datastore.
+func get(c Context, key *datastore.Key, value *stringer) error {
+	values := make([]stringer, 1)
+	err := c.GetMulti([]*datastore.Key{key}, values)
+	if me, ok := err.(appengine.MultiError); ok {
+		return me[0]
+	}
+	*value = values[0]
+
+	return err
+}
+
+func TestPutKeysCanceled(t *testing.T) {
+	h := testhelper.New(t)
+
+	// Cancel the context before we use it.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := NewStandaloneContext().WithContext(ctx)
+
+	// Make the request and writer.
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/datastore", nil)
+	h.FatalNotNil("creating request", err)
+
+	ok := PutKeys(c, w, r, []*datastore.Key{makeKey(c, nil)},
+		[]stringer{stringer{"one"}})
+	h.FatalNotEqual("put keys", ok, false)
+
+	h.ErrorNotEqual("response code", w.Code, http.StatusInternalServerError)
+	h.ErrorNotEqual("response body", w.Body.String(),
+		`{"Type":"error","Message":"Something unexpected happened."}`)
+}
+
+func TestDatastoreError(t *testing.T) {
+	h := testhelper.New(t)
+
+	tests := []struct {
+		err    error
+		ecode  int
+		ebody  string
+		eretry string
+	}{
+		// A missing entity.
+		{
+			err:   datastore.ErrNoSuchEntity,
+			ecode: http.StatusNotFound,
+			ebody: `{"Type":"error","Message":"Not found."}`,
+		},
+
+		// A missing entity in a multi error.
+		{
+			err:   appengine.MultiError{nil, datastore.ErrNoSuchEntity},
+			ecode: http.StatusNotFound,
+			ebody: `{"Type":"error","Message":"Not found."}`,
+		},
+
+		// An invalid key.
+		{
+			err:   datastore.ErrInvalidKey,
+			ecode: http.StatusBadRequest,
+			ebody: `{"Type":"error","Message":"Invalid key."}`,
+		},
+
+		// A concurrent transaction.
+		{
+			err:    datastore.ErrConcurrentTransaction,
+			ecode:  http.StatusServiceUnavailable,
+			ebody:  `{"Type":"error","Message":"Busy. Please try again."}`,
+			eretry: "1",
+		},
+
+		// An invalid entity type.
+		{
+			err:   datastore.ErrInvalidEntityType,
+			ecode: http.StatusInternalServerError,
+			ebody: `{"Type":"error","Message":"Something unexpected happened."}`,
+		},
+	}
+
+	c := NewStandaloneContext()
+
+	for i, test := range tests {
+		h.SetIndex(i)
+		h.SetFunc("LogAndError(c, w, r, DatastoreError(%v))", test.err)
+
+		// Make the request and writer.
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/datastore", nil)
+		h.FatalNotNil("creating request", err)
+
+		LogAndError(c, w, r, DatastoreError(test.err))
+
+		// Check the values.
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+		h.ErrorNotEqual("retry after", w.Header().Get("Retry-After"),
+			test.eretry)
+	}
 }
@@ -0,0 +1,224 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrUnsupportedMediaType is sent when a request body has a
+// Content-Type no decoder is registered for.
+var ErrUnsupportedMediaType = RegisterError(&Error{
+	Code:     "unsupportedmediatype",
+	Status:   http.StatusUnsupportedMediaType,
+	Message:  "Unsupported media type.",
+	Severity: "info",
+})
+
+// Decoder turns the bytes of a request body into the value pointed
+// to by v.
+type Decoder func(data []byte, v interface{}) error
+
+// decoders are the registered decoders by media type.
+var (
+	decodersMu sync.RWMutex
+	decoders   = make(map[string]Decoder)
+)
+
+func init() {
+	RegisterDecoder("application/json", unmarshalJSON)
+	RegisterDecoder("text/json", unmarshalJSON)
+	RegisterDecoder("application/xml", xml.Unmarshal)
+	RegisterDecoder("text/xml", xml.Unmarshal)
+	RegisterDecoder("application/x-www-form-urlencoded", UnmarshalForm)
+	RegisterDecoder("application/msgpack", msgpack.Unmarshal)
+	RegisterDecoder("application/x-msgpack", msgpack.Unmarshal)
+}
+
+// RegisterDecoder makes UnmarshalFromBodyOrFail able to read bodies
+// of the given media type (e.g. "application/x-protobuf") using
+// d. Registering a media type again replaces its decoder.
+func RegisterDecoder(mediaType string, d Decoder) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+
+	decoders[strings.ToLower(mediaType)] = d
+}
+
+// findDecoder returns the decoder for the given Content-Type. An
+// empty Content-Type is treated as JSON and types with a "+json" or
+// "+xml" suffix (e.g. "application/merge-patch+json") use the JSON
+// or XML decoder if nothing is registered for them.
+func findDecoder(ctype string) (Decoder, error) {
+	mediaType := "application/json"
+	if strings.TrimSpace(ctype) != "" {
+		mt, _, err := mime.ParseMediaType(ctype)
+		if err != nil {
+			return nil, err
+		}
+		mediaType = mt
+	}
+
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+
+	if d, ok := decoders[mediaType]; ok {
+		return d, nil
+	}
+
+	switch {
+	case strings.HasSuffix(mediaType, "+json"):
+		if d, ok := decoders["application/json"]; ok {
+			return d, nil
+		}
+	case strings.HasSuffix(mediaType, "+xml"):
+		if d, ok := decoders["application/xml"]; ok {
+			return d, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no decoder for %q", mediaType)
+}
+
+// UnmarshalForm is a Decoder for application/x-www-form-urlencoded
+// bodies. v must be a pointer to a struct. Each field is set from the
+// form value with its name, which is the name in its "form" tag or,
+// without one, its JSON name. Fields may be strings, bools, numbers,
+// or slices of them. Form values without a field are ignored.
+func UnmarshalForm(data []byte, v interface{}) error {
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return err
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() ||
+		rv.Elem().Kind() != reflect.Struct {
+
+		return fmt.Errorf("form: can't decode into %T", v)
+	}
+
+	return unmarshalFormStruct(values, rv.Elem())
+}
+
+// unmarshalFormStruct sets the fields of the struct from the values.
+func unmarshalFormStruct(values url.Values, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		embedded := f.Anonymous && f.Type.Kind() == reflect.Struct
+		if f.PkgPath != "" && !embedded {
+			continue
+		}
+
+		name, named := jsonName(f)
+		if tag := f.Tag.Get("form"); tag != "" {
+			name, named = tag, true
+		}
+		if name == "-" {
+			continue
+		}
+
+		// Embedded structs are flattened like encoding/json does.
+		if embedded && !named {
+			if err := unmarshalFormStruct(values, v.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		vals, ok := values[name]
+		if !ok {
+			continue
+		}
+		if err := setFormField(v.Field(i), vals); err != nil {
+			return fmt.Errorf("form: %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// setFormField sets the field from the form values.
+func setFormField(v reflect.Value, vals []string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		nv := reflect.New(v.Type().Elem())
+		if err := setFormField(nv.Elem(), vals); err != nil {
+			return err
+		}
+		v.Set(nv)
+		return nil
+
+	case reflect.Slice:
+		sv := reflect.MakeSlice(v.Type(), len(vals), len(vals))
+		for x, val := range vals {
+			if err := setFormValue(sv.Index(x), val); err != nil {
+				return err
+			}
+		}
+		v.Set(sv)
+		return nil
+	}
+
+	if len(vals) == 0 {
+		return nil
+	}
+	return setFormValue(v, vals[0])
+}
+
+// setFormValue parses a single form value into v.
+func setFormValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
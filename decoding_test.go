@@ -0,0 +1,124 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"github.com/icub3d/gorca/internal/testhelper"
+	"github.com/vmihailenco/msgpack/v5"
+	"testing"
+)
+
+// formEmbedded is embedded in formItem to test flattening.
+type formEmbedded struct {
+	Note string
+}
+
+// formItem has a field of each type UnmarshalForm supports.
+type formItem struct {
+	formEmbedded
+	Name    string `json:"name"`
+	Tag     string `form:"t"`
+	Count   int64
+	Size    uint8
+	Price   float64
+	Done    bool
+	Labels  []string
+	Owner   *string
+	Skipped string `json:"-"`
+}
+
+func TestUnmarshalForm(t *testing.T) {
+	h := testhelper.New(t)
+
+	owner := "bob"
+
+	tests := []struct {
+		data     string
+		v        interface{}
+		expected interface{}
+		err      bool
+	}{
+		// All of the types.
+		{
+			data: "name=milk&t=food&Count=-2&Size=3&Price=1.5&Done=true" +
+				"&Labels=a&Labels=b&Owner=bob&Note=hi&Skipped=no&Extra=1",
+			v: &formItem{},
+			expected: &formItem{
+				formEmbedded: formEmbedded{"hi"},
+				Name:         "milk",
+				Tag:          "food",
+				Count:        -2,
+				Size:         3,
+				Price:        1.5,
+				Done:         true,
+				Labels:       []string{"a", "b"},
+				Owner:        &owner,
+			},
+		},
+
+		// A bad number.
+		{
+			data: "Count=many",
+			v:    &formItem{},
+			err:  true,
+		},
+
+		// An overflow.
+		{
+			data: "Size=256",
+			v:    &formItem{},
+			err:  true,
+		},
+
+		// A bad form.
+		{
+			data: "name=%zz",
+			v:    &formItem{},
+			err:  true,
+		},
+
+		// Not a struct.
+		{
+			data: "name=milk",
+			v:    new(string),
+			err:  true,
+		},
+
+		// An unsupported type.
+		{
+			data: "M=1",
+			v:    &struct{ M map[string]string }{},
+			err:  true,
+		},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		err := UnmarshalForm([]byte(test.data), test.v)
+		h.ErrorNotEqual("error", err != nil, test.err)
+		if !test.err {
+			h.ErrorNotEqual("decoded", test.v, test.expected)
+		}
+	}
+}
+
+func TestRegisterDecoder(t *testing.T) {
+	h := testhelper.New(t)
+
+	_, err := findDecoder("application/x-test")
+	h.ErrorNil("unregistered", err)
+
+	RegisterDecoder("Application/X-Test", msgpack.Unmarshal)
+	d, err := findDecoder("application/x-test; charset=binary")
+	h.FatalNotNil("registered", err)
+
+	b, err := msgpack.Marshal(struct{ C int64 }{123})
+	h.FatalNotNil("marshal", err)
+
+	var v struct{ C int64 }
+	h.FatalNotNil("decode", d(b, &v))
+	h.ErrorNotEqual("decoded", v.C, int64(123))
+}
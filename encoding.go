@@ -0,0 +1,188 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNotAcceptable is sent when none of the registered encoders
+// produce a media type the request accepts.
+var ErrNotAcceptable = RegisterError(&Error{
+	Code:     "notacceptable",
+	Status:   http.StatusNotAcceptable,
+	Message:  "Not acceptable.",
+	Severity: "info",
+})
+
+// Encoder turns a value into the bytes of a response body.
+type Encoder func(v interface{}) ([]byte, error)
+
+// encoder is a registered Encoder and its media type.
+type encoder struct {
+	mediaType string
+	encode    Encoder
+}
+
+// encoders are the registered encoders in the order they were
+// registered.
+var (
+	encodersMu sync.RWMutex
+	encoders   []encoder
+)
+
+func init() {
+	RegisterEncoder("application/json", json.Marshal)
+	RegisterEncoder("application/xml", xml.Marshal)
+	RegisterEncoder("application/msgpack", msgpack.Marshal)
+	RegisterEncoder("application/x-msgpack", msgpack.Marshal)
+	RegisterEncoder("application/cbor", cbor.Marshal)
+}
+
+// RegisterEncoder makes WriteData able to send the given media type
+// (e.g. "application/x-protobuf") using e. Registering a media type
+// again replaces its encoder. When the request accepts any type, the
+// first registered encoder (JSON) is used.
+func RegisterEncoder(mediaType string, e Encoder) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+
+	mediaType = strings.ToLower(mediaType)
+	for x := range encoders {
+		if encoders[x].mediaType == mediaType {
+			encoders[x].encode = e
+			return
+		}
+	}
+
+	encoders = append(encoders, encoder{mediaType, e})
+}
+
+// WriteData encodes the given data with the registered encoder the
+// request's Accept header prefers and sends it as a response. Without
+// an Accept header, JSON is sent. If nothing acceptable is registered,
+// a 406 is sent instead. See ETags for conditional GETs.
+func WriteData(c Context, w http.ResponseWriter, r *http.Request,
+	data interface{}) {
+
+	writeData(c, w, r, data, http.StatusOK)
+}
+
+// writeData is WriteData with the given status code.
+func writeData(c Context, w http.ResponseWriter, r *http.Request,
+	data interface{}, code int) {
+
+	w.Header().Add("Vary", "Accept")
+
+	e, ok := negotiate(r.Header.Get("Accept"))
+	if !ok {
+		LogAndError(c, w, r, ErrNotAcceptable.Wrap(
+			fmt.Errorf("no encoder for %q", r.Header.Get("Accept"))))
+		return
+	}
+
+	b, err := e.encode(data)
+	if err != nil {
+		LogAndUnexpected(c, w, r, fmt.Errorf("writing %s: %s",
+			e.mediaType, err))
+		return
+	}
+
+	ctype := e.mediaType
+	if ctype == "application/json" || strings.HasSuffix(ctype, "xml") {
+		ctype += "; charset=utf-8"
+	}
+	writeBody(c, w, r, ctype, b, code)
+}
+
+// negotiate returns the registered encoder with the highest quality
+// in the given Accept header. Ties go to the encoder registered
+// first. If nothing is acceptable, false is returned.
+func negotiate(accept string) (encoder, bool) {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+
+	if len(encoders) == 0 {
+		return encoder{}, false
+	}
+	if strings.TrimSpace(accept) == "" {
+		return encoders[0], true
+	}
+
+	ranges := parseAccept(accept)
+
+	var best encoder
+	bestq := 0.0
+	for _, e := range encoders {
+		if q := acceptQuality(ranges, e.mediaType); q > bestq {
+			best, bestq = e, q
+		}
+	}
+
+	return best, bestq > 0
+}
+
+// mediaRange is a single media range from an Accept header.
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept parses the media ranges in an Accept header. Ranges
+// that can't be parsed are ignored.
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+
+		ranges = append(ranges, mediaRange{mt, q})
+	}
+
+	return ranges
+}
+
+// acceptQuality returns the quality of the most specific of the
+// ranges that matches the media type, or zero if none match.
+func acceptQuality(ranges []mediaRange, mediaType string) float64 {
+	major := strings.SplitN(mediaType, "/", 2)[0]
+
+	q, specificity := 0.0, -1
+	for _, mr := range ranges {
+		s := -1
+		switch {
+		case mr.mediaType == mediaType:
+			s = 2
+		case mr.mediaType == major+"/*":
+			s = 1
+		case mr.mediaType == "*/*":
+			s = 0
+		}
+
+		if s > specificity {
+			q, specificity = mr.q, s
+		}
+	}
+
+	return q
+}
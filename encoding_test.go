@@ -0,0 +1,119 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/icub3d/gorca/internal/testhelper"
+	"github.com/vmihailenco/msgpack/v5"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteData(t *testing.T) {
+	h := testhelper.New(t)
+
+	RegisterEncoder("text/x-test", func(v interface{}) ([]byte, error) {
+		return []byte(fmt.Sprint(v)), nil
+	})
+
+	data := Message{Type: "success", Message: "hello"}
+
+	tests := []struct {
+		accept string
+		ecode  int
+		ectype string
+		decode func([]byte, interface{}) error
+		ebody  string
+	}{
+		// No Accept header.
+		{
+			ecode:  http.StatusOK,
+			ectype: "application/json; charset=utf-8",
+			decode: json.Unmarshal,
+		},
+
+		// Anything.
+		{
+			accept: "*/*",
+			ecode:  http.StatusOK,
+			ectype: "application/json; charset=utf-8",
+			decode: json.Unmarshal,
+		},
+
+		// XML is preferred.
+		{
+			accept: "application/json;q=0.5, application/xml",
+			ecode:  http.StatusOK,
+			ectype: "application/xml; charset=utf-8",
+			decode: xml.Unmarshal,
+		},
+
+		// MessagePack.
+		{
+			accept: "application/msgpack",
+			ecode:  http.StatusOK,
+			ectype: "application/msgpack",
+			decode: msgpack.Unmarshal,
+		},
+
+		// CBOR is more specific than the wildcard.
+		{
+			accept: "application/*;q=0.1, application/cbor;q=0.9",
+			ecode:  http.StatusOK,
+			ectype: "application/cbor",
+			decode: cbor.Unmarshal,
+		},
+
+		// A registered encoder.
+		{
+			accept: "text/*",
+			ecode:  http.StatusOK,
+			ectype: "text/x-test",
+			ebody:  "{success hello [] <nil>}",
+		},
+
+		// Nothing acceptable.
+		{
+			accept: "image/png, application/json;q=0",
+			ecode:  http.StatusNotAcceptable,
+			ectype: "text/json; charset=utf-8",
+			ebody:  `{"Type":"error","Message":"Not acceptable."}`,
+		},
+	}
+
+	c := NewStandaloneContext()
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/", nil)
+		h.FatalNotNil("creating request", err)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+
+		WriteData(c, w, r, data)
+
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		h.ErrorNotEqual("content type", w.Header().Get("Content-Type"),
+			test.ectype)
+		h.ErrorNotEqual("vary", w.Header().Get("Vary"), "Accept")
+
+		if test.decode == nil {
+			h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+			continue
+		}
+
+		var m Message
+		h.FatalNotNil("decoding", test.decode(w.Body.Bytes(), &m))
+		h.ErrorNotEqual("decoded", m, data)
+	}
+}
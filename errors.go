@@ -0,0 +1,191 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Error is an API error that can be sent as a response. The
+// registered errors (see RegisterError) are used as templates and
+// wrapped around the actual cause with Wrap.
+type Error struct {
+	// Code identifies the error (e.g. "notfound").
+	Code string
+
+	// Status is the HTTP status code sent with the error.
+	Status int
+
+	// Message is the public message sent to the client.
+	Message string
+
+	// Severity is the priority the error is logged with. See Log for
+	// the accepted values.
+	Severity string
+
+	// RetryAfter, if not zero, is sent as the Retry-After header to
+	// tell the client when to try again.
+	RetryAfter time.Duration
+
+	// Err is the underlying cause. It is logged but never sent to
+	// the client.
+	Err error
+}
+
+// These are the errors gorca registers for itself. Their messages
+// and severities can be changed during initialization.
+var (
+	ErrInvalid = RegisterError(&Error{
+		Code:     "invalid",
+		Status:   http.StatusUnprocessableEntity,
+		Message:  "Invalid.",
+		Severity: "error",
+	})
+
+	ErrFailed = RegisterError(&Error{
+		Code:     "failed",
+		Status:   http.StatusBadRequest,
+		Message:  "Failed.",
+		Severity: "error",
+	})
+
+	ErrNotFound = RegisterError(&Error{
+		Code:     "notfound",
+		Status:   http.StatusNotFound,
+		Message:  "Not found.",
+		Severity: "error",
+	})
+
+	ErrUnauthorized = RegisterError(&Error{
+		Code:     "unauthorized",
+		Status:   http.StatusForbidden,
+		Message:  "You are not authorized to do that.",
+		Severity: "error",
+	})
+
+	ErrUnexpected = RegisterError(&Error{
+		Code:     "unexpected",
+		Status:   http.StatusInternalServerError,
+		Message:  "Something unexpected happened.",
+		Severity: "error",
+	})
+)
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Code
+	}
+
+	return e.Code + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying cause.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the target is an *Error with the same code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Wrap returns a copy of the error with the given cause.
+func (e *Error) Wrap(err error) *Error {
+	ne := *e
+	ne.Err = err
+	return &ne
+}
+
+// errorCause maps an error to the registered error sent for it.
+type errorCause struct {
+	cause error
+	e     *Error
+}
+
+// errorCodes contains the registered errors by their code.
+var errorCodes map[string]*Error = map[string]*Error{}
+
+// errorCauses contains the errors mapped to registered errors.
+var errorCauses []errorCause
+
+// RegisterError adds the given error to the registry, replacing any
+// error with the same code. Any errors in causes (or errors wrapping
+// them) are sent as e by LogAndError. It returns e so it can be used
+// in a variable declaration. It should only be called during
+// initialization.
+func RegisterError(e *Error, causes ...error) *Error {
+	errorCodes[e.Code] = e
+	for _, cause := range causes {
+		errorCauses = append(errorCauses, errorCause{cause: cause, e: e})
+	}
+
+	return e
+}
+
+// LookupError returns the registered error with the given code.
+func LookupError(code string) (*Error, bool) {
+	e, ok := errorCodes[code]
+	return e, ok
+}
+
+// FindError returns the error that should be sent for err. If err is
+// or wraps an *Error, that is returned. If it is or wraps a cause
+// given to RegisterError, the error it was registered with is
+// returned, preferring the most recent registration. Otherwise,
+// ErrUnexpected is returned.
+func FindError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	for i := len(errorCauses) - 1; i >= 0; i-- {
+		if errors.Is(err, errorCauses[i].cause) {
+			return errorCauses[i].e
+		}
+	}
+
+	return ErrUnexpected
+}
+
+// writeError sends the given error as the response. It is a Problem
+// if ProblemDetails is on and a Message otherwise. If the error wraps
+// a ValidationError, the invalid fields are included. If it wraps a
+// VersionConflict, the current version is included.
+func writeError(c Context, w http.ResponseWriter, r *http.Request,
+	e *Error) {
+
+	var fields ValidationError
+	errors.As(e.Err, &fields)
+
+	var version *int64
+	var conflict *VersionConflict
+	if errors.As(e.Err, &conflict) {
+		version = &conflict.Current
+	}
+
+	if e.RetryAfter > 0 {
+		seconds := int((e.RetryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+
+	if ProblemDetails {
+		p := NewProblem(r, e.Status, e.Message)
+		p.Code = e.Code
+		p.Fields = fields
+		p.Version = version
+		WriteProblem(c, w, r, p)
+		return
+	}
+
+	m := Message{Type: "error", Message: e.Message, Fields: fields,
+		Version: version}
+	writeMessage(c, w, r, m, e.Status)
+}
@@ -0,0 +1,143 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"errors"
+	"fmt"
+	"github.com/icub3d/gorca/internal/testhelper"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// errGone is a sentinel error registered in the tests.
+var errGone = errors.New("it's gone")
+
+// ErrGone is an application error registered in the tests.
+var ErrGone = RegisterError(&Error{
+	Code:     "gone",
+	Status:   http.StatusGone,
+	Message:  "It's gone.",
+	Severity: "warn",
+}, errGone)
+
+func TestFindError(t *testing.T) {
+	h := testhelper.New(t)
+
+	tests := []struct {
+		err      error
+		expected *Error
+	}{
+		// A nil error.
+		{
+			err:      nil,
+			expected: ErrUnexpected,
+		},
+
+		// An unknown error.
+		{
+			err:      fmt.Errorf("who knows"),
+			expected: ErrUnexpected,
+		},
+
+		// A registered error.
+		{
+			err:      ErrNotFound,
+			expected: ErrNotFound,
+		},
+
+		// A wrapped registered error.
+		{
+			err:      fmt.Errorf("loading: %w", ErrFailed.Wrap(errGone)),
+			expected: ErrFailed,
+		},
+
+		// A registered cause.
+		{
+			err:      errGone,
+			expected: ErrGone,
+		},
+
+		// A wrapped registered cause.
+		{
+			err:      fmt.Errorf("loading: %w", errGone),
+			expected: ErrGone,
+		},
+	}
+
+	for i, test := range tests {
+		h.SetIndex(i)
+		h.SetFunc("FindError(%v)", test.err)
+
+		e := FindError(test.err)
+		h.ErrorNotEqual("code", e.Code, test.expected.Code)
+		h.ErrorNotEqual("status", e.Status, test.expected.Status)
+	}
+}
+
+func TestErrorWrap(t *testing.T) {
+	h := testhelper.New(t)
+
+	err := ErrNotFound.Wrap(errGone)
+	h.ErrorNotEqual("message", err.Error(), "notfound: it's gone")
+	h.ErrorNotEqual("is not found", errors.Is(err, ErrNotFound), true)
+	h.ErrorNotEqual("is cause", errors.Is(err, errGone), true)
+	h.ErrorNotEqual("is failed", errors.Is(err, ErrFailed), false)
+	h.ErrorNotEqual("template untouched", ErrNotFound.Err, nil)
+
+	e, ok := LookupError("gone")
+	h.FatalNotEqual("lookup", ok, true)
+	h.ErrorNotEqual("lookup error", e, ErrGone)
+}
+
+func TestLogAndError(t *testing.T) {
+	h := testhelper.New(t)
+
+	tests := []struct {
+		err   error
+		ecode int
+		ebody string
+	}{
+		// An unknown error.
+		{
+			err:   fmt.Errorf("who knows"),
+			ecode: http.StatusInternalServerError,
+			ebody: `{"Type":"error","Message":"Something unexpected happened."}`,
+		},
+
+		// A wrapped registered cause.
+		{
+			err:   fmt.Errorf("loading: %w", errGone),
+			ecode: http.StatusGone,
+			ebody: `{"Type":"error","Message":"It's gone."}`,
+		},
+
+		// An unauthorized error.
+		{
+			err:   ErrUnauthorized,
+			ecode: http.StatusForbidden,
+			ebody: `{"Type":"error","Message":"You are not authorized to do that."}`,
+		},
+	}
+
+	c := NewStandaloneContext()
+
+	for i, test := range tests {
+		h.SetIndex(i)
+
+		// Make the request and writer.
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/", nil)
+		h.FatalNotNil("creating request", err)
+
+		h.SetFunc("LogAndError(c, w, r, %v)", test.err)
+		LogAndError(c, w, r, test.err)
+
+		// Check the values.
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+	}
+}
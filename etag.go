@@ -0,0 +1,143 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ETags turns on strong ETags for the responses sent by WriteJSON and
+// WriteData. When it is on, a GET whose If-None-Match has the ETag of
+// the response gets a 304 Not Modified without a body.
+var ETags bool = false
+
+// ErrPreconditionFailed is sent when a request's If-Match doesn't
+// have the ETag of the current entity.
+var ErrPreconditionFailed = RegisterError(&Error{
+	Code:     "preconditionfailed",
+	Status:   http.StatusPreconditionFailed,
+	Message:  "The entity has changed.",
+	Severity: "info",
+})
+
+// ETag returns the strong ETag for the given response body.
+func ETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// writeBody sends the body with the given content type and status
+// code. If ETags is on, the ETag of successful GETs is sent and
+// matching If-None-Match headers get a 304.
+func writeBody(c Context, w http.ResponseWriter, r *http.Request,
+	ctype string, body []byte, code int) {
+
+	w.Header().Set("Content-Type", ctype)
+
+	if ETags && code == http.StatusOK &&
+		(r.Method == "GET" || r.Method == "HEAD") {
+
+		etag := ETag(body)
+		w.Header().Set("ETag", etag)
+
+		if matchETag(r.Header.Get("If-None-Match"), etag, true) {
+			w.Header().Del("Content-Type")
+			if Compression {
+				w.Header().Add("Vary", "Accept-Encoding")
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	writeResponse(c, w, r, body, code)
+}
+
+// IfMatchOrFail is a helper function that checks the request's
+// If-Match header against the ETag of current, which should be what a
+// GET of the entity would send (e.g. an Entity). It is encoded as
+// WriteData would for the request. If there is no If-Match, true is
+// returned. If the request's ETags don't match, false is returned and
+// a 412 was returned to the request. This case should be terminal.
+// Call it before saving the entity in PUT and PATCH handlers to keep
+// clients from overwriting changes they haven't seen. current must be
+// loaded, and the entity saved, in the same transaction (see
+// RunInTransactionOrFail). Otherwise, two requests with the same ETag
+// can both pass. In a transaction's function, use CheckIfMatch.
+func IfMatchOrFail(c Context, w http.ResponseWriter, r *http.Request,
+	current interface{}) bool {
+
+	if err := CheckIfMatch(r, current); err != nil {
+		LogAndError(c, w, r, err)
+		return false
+	}
+
+	return true
+}
+
+// CheckIfMatch is IfMatchOrFail returning the error to send instead
+// of sending it: an ErrPreconditionFailed if the ETags don't match.
+// It can be returned from the function given to
+// RunInTransactionOrFail.
+func CheckIfMatch(r *http.Request, current interface{}) error {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return nil
+	}
+
+	e, ok := negotiate(r.Header.Get("Accept"))
+	if !ok {
+		return ErrNotAcceptable.Wrap(
+			fmt.Errorf("no encoder for %q", r.Header.Get("Accept")))
+	}
+
+	b, err := e.encode(current)
+	if err != nil {
+		return ErrUnexpected.Wrap(fmt.Errorf("writing %s: %s",
+			e.mediaType, err))
+	}
+
+	etag := ETag(b)
+	if !matchETag(ifMatch, etag, false) {
+		return ErrPreconditionFailed.Wrap(
+			fmt.Errorf("If-Match %s is not %s", ifMatch, etag))
+	}
+
+	return nil
+}
+
+// matchETag returns true if the list of ETags in an If-Match or
+// If-None-Match header has the given ETag or is "*". Weak ETags only
+// match if weak is true. The content encoding added to ETags of
+// compressed responses is ignored.
+func matchETag(header, etag string, weak bool) bool {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+
+		if trimETagEncoding(tag) == etag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,184 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"github.com/icub3d/gorca/internal/testhelper"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteDataETags(t *testing.T) {
+	h := testhelper.New(t)
+
+	defer func(etags bool) { ETags = etags }(ETags)
+
+	data := Message{Type: "success", Message: "hello"}
+	body := `{"Type":"success","Message":"hello"}`
+	etag := ETag([]byte(body))
+
+	tests := []struct {
+		etags       bool
+		method      string
+		ifNoneMatch string
+		ecode       int
+		eetag       string
+		ebody       string
+	}{
+		// ETags are off.
+		{
+			method:      "GET",
+			ifNoneMatch: etag,
+			ecode:       http.StatusOK,
+			ebody:       body,
+		},
+
+		// No If-None-Match.
+		{
+			etags:  true,
+			method: "GET",
+			ecode:  http.StatusOK,
+			eetag:  etag,
+			ebody:  body,
+		},
+
+		// A match.
+		{
+			etags:       true,
+			method:      "GET",
+			ifNoneMatch: `"other", ` + etag,
+			ecode:       http.StatusNotModified,
+			eetag:       etag,
+		},
+
+		// A weak match.
+		{
+			etags:       true,
+			method:      "GET",
+			ifNoneMatch: "W/" + etag,
+			ecode:       http.StatusNotModified,
+			eetag:       etag,
+		},
+
+		// Anything.
+		{
+			etags:       true,
+			method:      "GET",
+			ifNoneMatch: "*",
+			ecode:       http.StatusNotModified,
+			eetag:       etag,
+		},
+
+		// No match.
+		{
+			etags:       true,
+			method:      "GET",
+			ifNoneMatch: `"other"`,
+			ecode:       http.StatusOK,
+			eetag:       etag,
+			ebody:       body,
+		},
+
+		// Only GETs are tagged.
+		{
+			etags:       true,
+			method:      "POST",
+			ifNoneMatch: etag,
+			ecode:       http.StatusOK,
+			ebody:       body,
+		},
+	}
+
+	c := NewStandaloneContext()
+
+	for k, test := range tests {
+		h.SetIndex(k)
+		ETags = test.etags
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(test.method, "/", nil)
+		h.FatalNotNil("creating request", err)
+		if test.ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", test.ifNoneMatch)
+		}
+
+		WriteData(c, w, r, data)
+
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		h.ErrorNotEqual("etag", w.Header().Get("ETag"), test.eetag)
+		h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+	}
+}
+
+func TestIfMatchOrFail(t *testing.T) {
+	h := testhelper.New(t)
+
+	current := Message{Type: "success", Message: "hello"}
+	etag := ETag([]byte(`{"Type":"success","Message":"hello"}`))
+
+	tests := []struct {
+		ifMatch string
+		accept  string
+		result  bool
+		ecode   int
+		ebody   string
+	}{
+		// No If-Match.
+		{
+			result: true,
+		},
+
+		// Anything.
+		{
+			ifMatch: "*",
+			result:  true,
+		},
+
+		// A match.
+		{
+			ifMatch: `"other", ` + etag,
+			result:  true,
+		},
+
+		// Weak ETags don't match.
+		{
+			ifMatch: "W/" + etag,
+			ecode:   http.StatusPreconditionFailed,
+			ebody:   `{"Type":"error","Message":"The entity has changed."}`,
+		},
+
+		// The ETag of another encoding doesn't match.
+		{
+			ifMatch: etag,
+			accept:  "application/xml",
+			ecode:   http.StatusPreconditionFailed,
+			ebody:   `{"Type":"error","Message":"The entity has changed."}`,
+		},
+	}
+
+	c := NewStandaloneContext()
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("PUT", "/", nil)
+		h.FatalNotNil("creating request", err)
+		if test.ifMatch != "" {
+			r.Header.Set("If-Match", test.ifMatch)
+		}
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+
+		result := IfMatchOrFail(c, w, r, current)
+		h.ErrorNotEqual("result", result, test.result)
+		if !test.result {
+			h.ErrorNotEqual("response code", w.Code, test.ecode)
+			h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+		}
+	}
+}
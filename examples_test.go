@@ -6,7 +6,6 @@ package gorca
 
 import (
 	"fmt"
-	"github.com/icub3d/appenginetesting"
 	"net/http"
 	"net/http/httptest"
 )
@@ -14,13 +13,8 @@ import (
 func ExampleLogAndNotFound() {
 	// Note: The LogAnd* functions all work in a similar fashion.
 
-	// Create an appengine context (in this case a mock one).
-	c, err := appenginetesting.NewContext(nil)
-	if err != nil {
-		fmt.Println("creating context", err)
-		return
-	}
-	defer c.Close()
+	// Create a context (in this case a standalone one).
+	c := NewStandaloneContext()
 
 	// Make the request and writer.
 	w := httptest.NewRecorder()
@@ -44,13 +38,8 @@ func ExampleLogAndNotFound() {
 }
 
 func ExampleGetUserOrUnexpected() {
-	// Create an appengine context (in this case a mock one).
-	c, err := appenginetesting.NewContext(nil)
-	if err != nil {
-		fmt.Println("creating context", err)
-		return
-	}
-	defer c.Close()
+	// Create a context (in this case a standalone one).
+	c := NewStandaloneContext()
 
 	// Make the request and writer.
 	w := httptest.NewRecorder()
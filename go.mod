@@ -0,0 +1,18 @@
+module github.com/icub3d/gorca
+
+go 1.21
+
+require (
+	github.com/evanphx/json-patch/v5 v5.9.11
+	github.com/fxamacker/cbor/v2 v2.9.4
+	github.com/golang-jwt/jwt/v5 v5.3.1
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	google.golang.org/appengine v1.6.8
+)
+
+require (
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	google.golang.org/protobuf v1.26.0 // indirect
+)
@@ -0,0 +1,103 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+// Package testhelper has the table test helpers gorca's tests use. It
+// keeps the API of github.com/icub3d/testhelper so the tests run with
+// nothing but the standard library.
+package testhelper
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// TestHelper reports failures for a test, prefixed with the index of
+// the table entry and the function being tested.
+type TestHelper struct {
+	t     *testing.T
+	index int
+	fn    string
+}
+
+// New returns a TestHelper for the test.
+func New(t *testing.T) *TestHelper {
+	return &TestHelper{t: t, index: -1}
+}
+
+// SetIndex sets the index of the table entry being tested.
+func (h *TestHelper) SetIndex(i int) {
+	h.index = i
+}
+
+// SetFunc sets the name of the function being tested. It is formatted
+// like fmt.Sprintf.
+func (h *TestHelper) SetFunc(format string, args ...interface{}) {
+	h.fn = fmt.Sprintf(format, args...)
+}
+
+// ErrorNil reports an error if v is nil.
+func (h *TestHelper) ErrorNil(msg string, v interface{}) {
+	h.t.Helper()
+	if isNil(v) {
+		h.t.Errorf("%s %s: expected a value, got nil", h.prefix(), msg)
+	}
+}
+
+// ErrorNotNil reports an error if v isn't nil.
+func (h *TestHelper) ErrorNotNil(msg string, v interface{}) {
+	h.t.Helper()
+	if !isNil(v) {
+		h.t.Errorf("%s %s: expected nil, got %v", h.prefix(), msg, v)
+	}
+}
+
+// FatalNotNil stops the test if v isn't nil.
+func (h *TestHelper) FatalNotNil(msg string, v interface{}) {
+	h.t.Helper()
+	if !isNil(v) {
+		h.t.Fatalf("%s %s: expected nil, got %v", h.prefix(), msg, v)
+	}
+}
+
+// ErrorNotEqual reports an error if got isn't deeply equal to
+// expected.
+func (h *TestHelper) ErrorNotEqual(msg string, got, expected interface{}) {
+	h.t.Helper()
+	if !reflect.DeepEqual(got, expected) {
+		h.t.Errorf("%s %s: got %#v, expected %#v", h.prefix(), msg, got,
+			expected)
+	}
+}
+
+// FatalNotEqual stops the test if got isn't deeply equal to expected.
+func (h *TestHelper) FatalNotEqual(msg string, got, expected interface{}) {
+	h.t.Helper()
+	if !reflect.DeepEqual(got, expected) {
+		h.t.Fatalf("%s %s: got %#v, expected %#v", h.prefix(), msg, got,
+			expected)
+	}
+}
+
+// prefix returns the table index and function failures are reported
+// with.
+func (h *TestHelper) prefix() string {
+	return fmt.Sprintf("[%d] %s", h.index, h.fn)
+}
+
+// isNil returns true if v is nil or a nil pointer, interface, slice,
+// map, channel or function.
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map,
+		reflect.Chan, reflect.Func:
+		return rv.IsNil()
+	}
+
+	return false
+}
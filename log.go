@@ -5,7 +5,6 @@
 package gorca
 
 import (
-	"appengine"
 	"fmt"
 	"net/http"
 )
@@ -13,7 +12,7 @@ import (
 // Log is a helper function that logs the given message to appenging
 // with the given priority. Accepted priorities are "debug", "info",
 // "warn", "error", and "crit". Other values default to "error".
-func Log(c appengine.Context, r *http.Request, priority string,
+func Log(c Context, r *http.Request, priority string,
 	message string, params ...interface{}) {
 
 	message = fmt.Sprintf("[%s] [%s] [%s]: %s", r.RemoteAddr, r.Method,
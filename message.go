@@ -5,7 +5,6 @@
 package gorca
 
 import (
-	"appengine"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -13,49 +12,77 @@ import (
 )
 
 // WriteJSON transforms the given data into JSON and sends it as a
-// response. If an error occurs, that will be returned instead.
-func WriteJSON(c appengine.Context, w http.ResponseWriter,
+// response. If an error occurs, that will be returned instead. See
+// ETags for conditional GETs.
+func WriteJSON(c Context, w http.ResponseWriter,
 	r *http.Request, data interface{}) {
 
+	writeJSON(c, w, r, data, http.StatusOK)
+}
+
+// writeJSON is WriteJSON with the given status code.
+func writeJSON(c Context, w http.ResponseWriter, r *http.Request,
+	data interface{}, code int) {
+
 	b, err := json.Marshal(data)
 	if err != nil {
 		LogAndUnexpected(c, w, r, fmt.Errorf("writing json: %s", err))
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/json; charset=utf-8")
-	WriteResponse(c, w, r, b)
+	writeBody(c, w, r, "text/json; charset=utf-8", b, code)
 }
 
-// WriteMessage prints a standard JSON message to the given writer.
-func WriteMessage(c appengine.Context, w http.ResponseWriter,
+// WriteMessage prints a standard JSON message to the given writer. If
+// ProblemDetails is on and the code is an error, a Problem is written
+// instead.
+func WriteMessage(c Context, w http.ResponseWriter,
 	r *http.Request, mtype, message string, code int) {
 
+	if ProblemDetails && code >= http.StatusBadRequest {
+		WriteProblem(c, w, r, NewProblem(r, code, message))
+		return
+	}
+
+	writeMessage(c, w, r, Message{Type: mtype, Message: message}, code)
+}
+
+// writeMessage sends the given message as the response.
+func writeMessage(c Context, w http.ResponseWriter, r *http.Request,
+	m Message, code int) {
+
 	// Make the JSON response.
-	m := Message{Type: mtype, Message: message}
 	b, err := json.Marshal(m)
 	if err != nil {
 		// Eeek! just return the message itself.
-		http.Error(w, message, code)
+		http.Error(w, m.Message, code)
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/json; charset=utf-8")
-	w.WriteHeader(code)
-	WriteResponse(c, w, r, b)
+	writeResponse(c, w, r, b, code)
 }
 
 // WriteSuccessMessage prints a JSON response of success to the given
 // writer.
-func WriteSuccessMessage(c appengine.Context, w http.ResponseWriter,
+func WriteSuccessMessage(c Context, w http.ResponseWriter,
 	r *http.Request) {
 
-	WriteMessage(c, w, r, "success", ErrMsgs["success"], http.StatusOK)
+	WriteMessage(c, w, r, "success", SuccessMessage, http.StatusOK)
+}
+
+// WriteAcceptedMessage prints a JSON response to the given writer
+// saying the request was accepted to be finished later.
+func WriteAcceptedMessage(c Context, w http.ResponseWriter,
+	r *http.Request) {
+
+	WriteMessage(c, w, r, "success", AcceptedMessage, http.StatusAccepted)
 }
 
 // WriteResponse writes the given data to the given response write. If
-// an error occurs, it is logged.
-func WriteResponse(c appengine.Context, w http.ResponseWriter,
+// an error occurs, it is logged. The data is written as is; see
+// Compression for the helpers that compress it.
+func WriteResponse(c Context, w http.ResponseWriter,
 	r *http.Request, bytes []byte) {
 
 	_, err := w.Write(bytes)
@@ -68,35 +95,45 @@ func WriteResponse(c appengine.Context, w http.ResponseWriter,
 
 // UnmarshalOrFail attempts to unmarshal the given bytes as JSON and
 // put it in where. if it fails, false is returned and a "failed"
-// message is returned. In that case, this should be terminal.
-func UnmarshalOrFail(c appengine.Context, w http.ResponseWriter,
+// message is returned. Unknown fields fail if StrictJSON is on. The
+// result is then validated (see ValidateOrFail). In either case, this
+// should be terminal.
+func UnmarshalOrFail(c Context, w http.ResponseWriter,
 	r *http.Request, bytes []byte, where interface{}) bool {
 
-	err := json.Unmarshal(bytes, where)
+	err := unmarshalJSON(bytes, where)
 	if err != nil {
 		LogAndFailed(c, w, r, err)
 		return false
 	}
 
-	return true
+	return ValidateOrFail(c, w, r, where)
 }
 
 // GetBodyOrFail attempts to read the body from the given request. If
 // it succeeds, the body is returned as a string as well as true. If
 // it fails, "" and false are returned. The failure is also loged and
-// generic error is returned as the response.
-func GetBodyOrFail(c appengine.Context, w http.ResponseWriter,
+// generic error is returned as the response. Bodies over MaxBodySize
+// are rejected with a 413.
+func GetBodyOrFail(c Context, w http.ResponseWriter,
 	r *http.Request) ([]byte, bool) {
 
-	// Read the body for the JSON.
+	// Read the body.
 	if r.Body == nil {
-		LogAndFailed(c, w, r, fmt.Errorf("no JSON found"))
+		LogAndFailed(c, w, r, fmt.Errorf("no body found"))
+		return nil, false
+	}
+	if !limitBody(c, w, r) {
 		return nil, false
 	}
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		LogAndUnexpected(c, w, r, err)
+		if isTooLarge(err) {
+			LogAndError(c, w, r, ErrTooLarge.Wrap(err))
+		} else {
+			LogAndUnexpected(c, w, r, err)
+		}
 		return nil, false
 	}
 
@@ -104,20 +141,61 @@ func GetBodyOrFail(c appengine.Context, w http.ResponseWriter,
 }
 
 // UnmarshalFromBodyOrFail attempts to read the body from the given
-// request and umarshal it as JSON into the given interface. If an
-// error occurs, the failure is logged and a generic message is
-// returned as the response. The boolean value returned signifies the
-// success of the operation.
-func UnmarshalFromBodyOrFail(c appengine.Context, w http.ResponseWriter,
+// request and decode it into the given interface with the decoder
+// registered for its Content-Type (see RegisterDecoder). A body
+// without a Content-Type is decoded as JSON. The result is then
+// validated (see ValidateOrFail). If no decoder is registered for the
+// Content-Type, a 415 is sent. If another error occurs, the failure
+// is logged and a generic message is returned as the response. The
+// boolean value returned signifies the success of the operation.
+func UnmarshalFromBodyOrFail(c Context, w http.ResponseWriter,
 	r *http.Request, v interface{}) bool {
-	body, success := GetBodyOrFail(c, w, r)
-	if !success {
+
+	unmarshal, ok := bodyUnmarshaler(c, w, r)
+	if !ok {
 		return false
 	}
 
-	if !UnmarshalOrFail(c, w, r, body, v) {
+	if err := unmarshal(v); err != nil {
+		LogAndError(c, w, r, err)
 		return false
 	}
 
 	return true
 }
+
+// bodyUnmarshaler reads the request body and returns a function that
+// decodes it into v and validates it like UnmarshalFromBodyOrFail.
+// The function may be called more than once (e.g. in a transaction).
+// Bodies that can't be decoded are an ErrFailed and invalid values an
+// ErrInvalid. If a failure occured, false is returned and a response
+// was returned to the request.
+func bodyUnmarshaler(c Context, w http.ResponseWriter,
+	r *http.Request) (func(v interface{}) error, bool) {
+
+	decode, err := findDecoder(r.Header.Get("Content-Type"))
+	if err != nil {
+		LogAndError(c, w, r, ErrUnsupportedMediaType.Wrap(err))
+		return nil, false
+	}
+
+	body, ok := GetBodyOrFail(c, w, r)
+	if !ok {
+		return nil, false
+	}
+
+	return func(v interface{}) error {
+		if err := decode(body, v); err != nil {
+			return ErrFailed.Wrap(err)
+		}
+
+		err := Validate(v)
+		if _, ok := err.(ValidationError); ok {
+			return ErrInvalid.Wrap(err)
+		} else if err != nil {
+			return ErrUnexpected.Wrap(err)
+		}
+
+		return nil
+	}, true
+}
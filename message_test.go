@@ -6,8 +6,7 @@ package gorca
 
 import (
 	"fmt"
-	"github.com/icub3d/appenginetesting"
-	"github.com/icub3d/testhelper"
+	"github.com/icub3d/gorca/internal/testhelper"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -47,9 +46,7 @@ func TestWriteJSON(t *testing.T) {
 	}
 
 	// We can use the same context for all tests.
-	c, err := appenginetesting.NewContext(nil)
-	h.FatalNotNil("creating context", err)
-	defer c.Close()
+	c := NewStandaloneContext()
 
 	for i, test := range tests {
 		h.SetIndex(i)
@@ -86,9 +83,7 @@ func TestWriteSuccessMessage(t *testing.T) {
 	}
 
 	// We are going to reuse the context.
-	c, err := appenginetesting.NewContext(nil)
-	h.FatalNotNil("creating context", err)
-	defer c.Close()
+	c := NewStandaloneContext()
 
 	for i, test := range tests {
 		h.SetIndex(i)
@@ -124,9 +119,7 @@ func TestWriteResponse(t *testing.T) {
 	}
 
 	// We are going to reuse the context.
-	c, err := appenginetesting.NewContext(nil)
-	h.FatalNotNil("creating context", err)
-	defer c.Close()
+	c := NewStandaloneContext()
 
 	for i, test := range tests {
 		h.SetIndex(i)
@@ -176,9 +169,7 @@ func TestUnmarshalOrFail(t *testing.T) {
 	}
 
 	// We are going to reuse the context.
-	c, err := appenginetesting.NewContext(nil)
-	h.FatalNotNil("creating context", err)
-	defer c.Close()
+	c := NewStandaloneContext()
 
 	for i, test := range tests {
 		h.SetIndex(i)
@@ -245,9 +236,7 @@ func TestGetBodyOrFail(t *testing.T) {
 	}
 
 	// We are going to reuse the context.
-	c, err := appenginetesting.NewContext(nil)
-	h.FatalNotNil("creating context", err)
-	defer c.Close()
+	c := NewStandaloneContext()
 
 	for i, test := range tests {
 		h.SetIndex(i)
@@ -320,12 +309,54 @@ func TestUnmarshalFromBodyOrFail(t *testing.T) {
 			request: newRequest("GET", "/", strings.NewReader(`{"C":12`)),
 			where:   &struct{ C int64 }{},
 		},
+
+		// Test an XML body.
+		{
+			result: true,
+			request: newTypedRequest("POST", "/", "application/xml",
+				`<X><C>123</C></X>`),
+			where: &struct{ C int64 }{},
+		},
+
+		// Test a form body.
+		{
+			result: true,
+			request: newTypedRequest("POST", "/",
+				"application/x-www-form-urlencoded", `C=123`),
+			where: &struct{ C int64 }{},
+		},
+
+		// Test a JSON body with a suffix.
+		{
+			result: true,
+			request: newTypedRequest("POST", "/",
+				"application/vnd.test+json; charset=utf-8", `{"C":123}`),
+			where: &struct{ C int64 }{},
+		},
+
+		// Test an unknown content type.
+		{
+			result: false,
+			ecode:  http.StatusUnsupportedMediaType,
+			ebody:  `{"Type":"error","Message":"Unsupported media type."}`,
+			request: newTypedRequest("POST", "/", "image/png",
+				`{"C":123}`),
+			where: &struct{ C int64 }{},
+		},
+
+		// Test a malformed content type.
+		{
+			result: false,
+			ecode:  http.StatusUnsupportedMediaType,
+			ebody:  `{"Type":"error","Message":"Unsupported media type."}`,
+			request: newTypedRequest("POST", "/", "application/",
+				`{"C":123}`),
+			where: &struct{ C int64 }{},
+		},
 	}
 
 	// We are going to reuse the context.
-	c, err := appenginetesting.NewContext(nil)
-	h.FatalNotNil("creating context", err)
-	defer c.Close()
+	c := NewStandaloneContext()
 
 	for i, test := range tests {
 		h.SetIndex(i)
@@ -357,6 +388,15 @@ func newRequest(method, url string, body io.Reader) *http.Request {
 	return r
 }
 
+// newTypedRequest is a helper function that makes a request with the
+// given body and Content-Type.
+func newTypedRequest(method, url, ctype, body string) *http.Request {
+	r := newRequest(method, url, strings.NewReader(body))
+	r.Header.Set("Content-Type", ctype)
+
+	return r
+}
+
 // ErrorRedader implements the Reader interface and always errors our
 // on the first read.
 type ErrorReader struct{}
@@ -0,0 +1,148 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"fmt"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+)
+
+// OwnerKind is the kind of the root keys that own entities. An entity
+// whose root ancestor is of this kind belongs to the principal whose
+// name (their email or, for a JWT, their subject) is the root's string
+// ID. See OwnerKey.
+var OwnerKind string = "Owner"
+
+// OwnerProperty is the property that names the principal an entity
+// belongs to when its root ancestor isn't of the OwnerKind.
+var OwnerProperty string = "Owner"
+
+// OwnerKey returns the root key of the entities the principal owns.
+// Use it as the parent of their entities.
+func OwnerKey(c Context, p *Principal) *datastore.Key {
+	return c.NewKey(OwnerKind, p.name(), 0, nil)
+}
+
+// rootKey returns the root ancestor of the key.
+func rootKey(key *datastore.Key) *datastore.Key {
+	for key.Parent() != nil {
+		key = key.Parent()
+	}
+
+	return key
+}
+
+// checkOwner makes sure the current principal (see currentPrincipal)
+// owns all of the keys and that they are of the given kind. The owner
+// of a key is found by its root ancestor or, if that isn't of the
+// OwnerKind, the OwnerProperty of its entity. Keys of another kind or
+// that belong to someone else are an ErrNotFound, so their existence
+// isn't leaked. If no one is logged in, it is an ErrUnauthenticated.
+func checkOwner(c Context, r *http.Request, kind string,
+	keys []*datastore.Key) error {
+
+	p := currentPrincipal(c, r)
+	if p == nil {
+		return ErrUnauthenticated.Wrap(fmt.Errorf("no user found, "+
+			"but %s entities are owned", kind))
+	}
+	owner := p.name()
+
+	// The keys without an owner root need their entity loaded.
+	var load []*datastore.Key
+	for _, key := range keys {
+		if key.Kind() != kind {
+			return ErrNotFound.Wrap(fmt.Errorf("key %v is not a %s", key,
+				kind))
+		}
+
+		root := rootKey(key)
+		if root.Kind() != OwnerKind {
+			load = append(load, key)
+		} else if root.StringID() != owner {
+			return ErrNotFound.Wrap(fmt.Errorf("%s doesn't own %v", owner,
+				key))
+		}
+	}
+	if len(load) == 0 {
+		return nil
+	}
+
+	props := make([]datastore.PropertyList, len(load))
+	if err := c.GetMulti(load, props); err != nil {
+		return DatastoreError(err)
+	}
+
+	for x, key := range load {
+		found := false
+		for _, prop := range props[x] {
+			if prop.Name == OwnerProperty && prop.Value == owner {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return ErrNotFound.Wrap(fmt.Errorf("%s doesn't own %v", owner,
+				key))
+		}
+	}
+
+	return nil
+}
+
+// OwnedStringToKey is a helper function like StringToKey that also
+// makes sure the key is of the given kind and belongs to the current
+// user (see checkOwner). If a failure occured, false is returned and
+// a response was returned to the request (a 404 for keys of another
+// kind or someone else's). This case should be terminal.
+func OwnedStringToKey(c Context, w http.ResponseWriter, r *http.Request,
+	kind string, key string) (*datastore.Key, bool) {
+
+	keys, ok := OwnedStringsToKeys(c, w, r, kind, []string{key})
+	if !ok {
+		return nil, false
+	}
+
+	return keys[0], true
+}
+
+// OwnedStringsToKeys is a helper function like StringsToKeys that
+// also makes sure the keys are of the given kind and belong to the
+// current user (see checkOwner). If a failure occured, false is
+// returned and a response was returned to the request. This case
+// should be terminal.
+func OwnedStringsToKeys(c Context, w http.ResponseWriter,
+	r *http.Request, kind string, keys []string) ([]*datastore.Key, bool) {
+
+	dkeys, ok := StringsToKeys(c, w, r, keys)
+	if !ok {
+		return nil, false
+	}
+
+	if err := checkOwner(c, r, kind, dkeys); err != nil {
+		LogAndError(c, w, r, err)
+		return nil, false
+	}
+
+	return dkeys, true
+}
+
+// DeleteOwnedStringKeys is a helper function like DeleteStringKeys
+// that only deletes keys of the given kind that belong to the current
+// user. If any of them don't, nothing is deleted. If a failure
+// occured, false is returned and a response was returned to the
+// request. This case should be terminal.
+func DeleteOwnedStringKeys(c Context, w http.ResponseWriter,
+	r *http.Request, kind string, keys []string) bool {
+
+	dkeys, ok := OwnedStringsToKeys(c, w, r, kind, keys)
+	if !ok {
+		return false
+	}
+
+	return DeleteKeys(c, w, r, dkeys)
+}
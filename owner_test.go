@@ -0,0 +1,169 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"github.com/icub3d/gorca/internal/testhelper"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// ownedItem is an entity that names its owner.
+type ownedItem struct {
+	Owner string
+	Name  string
+}
+
+func TestOwnedStringsToKeys(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	alice := &Principal{Email: "alice@example.com"}
+	bob := &Principal{Email: "bob@example.com"}
+
+	// Entities under an owner root.
+	aliceItem := c.NewKey("Item", "", 1, OwnerKey(c, alice))
+	bobItem := c.NewKey("Item", "", 2, OwnerKey(c, bob))
+	aliceChild := c.NewKey("Child", "", 3, aliceItem)
+
+	// Entities with an owner property.
+	aliceOwned := c.NewKey("Item", "", 4, nil)
+	bobOwned := c.NewKey("Item", "", 5, nil)
+	missing := c.NewKey("Item", "", 6, nil)
+
+	_, err := c.PutMulti(
+		[]*datastore.Key{aliceItem, bobItem, aliceChild, aliceOwned,
+			bobOwned},
+		[]*ownedItem{{}, {}, {}, {Owner: "alice@example.com"},
+			{Owner: "bob@example.com"}})
+	h.FatalNotNil("putting items", err)
+
+	tests := []struct {
+		user  *Principal
+		kind  string
+		keys  []*datastore.Key
+		ecode int
+	}{
+		// No one is logged in.
+		{
+			kind:  "Item",
+			keys:  []*datastore.Key{aliceItem},
+			ecode: http.StatusUnauthorized,
+		},
+
+		// Their own entities.
+		{
+			user:  alice,
+			kind:  "Item",
+			keys:  []*datastore.Key{aliceItem, aliceOwned},
+			ecode: http.StatusOK,
+		},
+		{
+			user:  alice,
+			kind:  "Child",
+			keys:  []*datastore.Key{aliceChild},
+			ecode: http.StatusOK,
+		},
+
+		// The wrong kind.
+		{
+			user:  alice,
+			kind:  "Child",
+			keys:  []*datastore.Key{aliceItem},
+			ecode: http.StatusNotFound,
+		},
+
+		// Someone else's.
+		{
+			user:  alice,
+			kind:  "Item",
+			keys:  []*datastore.Key{aliceItem, bobItem},
+			ecode: http.StatusNotFound,
+		},
+		{
+			user:  alice,
+			kind:  "Item",
+			keys:  []*datastore.Key{bobOwned},
+			ecode: http.StatusNotFound,
+		},
+
+		// A JWT with their email isn't them.
+		{
+			user: &Principal{ID: "999", Email: "alice@example.com",
+				Method: MethodJWT},
+			kind:  "Item",
+			keys:  []*datastore.Key{aliceItem, aliceOwned},
+			ecode: http.StatusNotFound,
+		},
+
+		// An entity that doesn't exist.
+		{
+			user:  alice,
+			kind:  "Item",
+			keys:  []*datastore.Key{missing},
+			ecode: http.StatusNotFound,
+		},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		skeys := make([]string, 0, len(test.keys))
+		for _, key := range test.keys {
+			skeys = append(skeys, key.Encode())
+		}
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/", nil)
+		h.FatalNotNil("creating request", err)
+		if test.user != nil {
+			r = WithPrincipal(r, test.user)
+		}
+
+		keys, ok := OwnedStringsToKeys(c, w, r, test.kind, skeys)
+		h.ErrorNotEqual("ok", ok, test.ecode == http.StatusOK)
+		if !ok {
+			h.ErrorNotEqual("response code", w.Code, test.ecode)
+			continue
+		}
+		h.ErrorNotEqual("keys", keys, test.keys)
+	}
+}
+
+func TestDeleteOwnedStringKeys(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	c.Login("alice@example.com", false)
+
+	alice := c.NewKey("Item", "", 1, OwnerKey(c, &Principal{
+		Email: "alice@example.com"}))
+	bob := c.NewKey("Item", "", 2, OwnerKey(c, &Principal{
+		Email: "bob@example.com"}))
+	_, err := c.PutMulti([]*datastore.Key{alice, bob},
+		[]*ownedItem{{Name: "alice"}, {Name: "bob"}})
+	h.FatalNotNil("putting items", err)
+
+	// Nothing is deleted if one of them is someone else's.
+	w := httptest.NewRecorder()
+	ok := DeleteOwnedStringKeys(c, w, newRequest("DELETE", "/", nil),
+		"Item", []string{alice.Encode(), bob.Encode()})
+	h.ErrorNotEqual("delete both", ok, false)
+	h.ErrorNotEqual("response code", w.Code, http.StatusNotFound)
+
+	items := make([]ownedItem, 2)
+	err = c.GetMulti([]*datastore.Key{alice, bob}, items)
+	h.FatalNotNil("getting items", err)
+
+	w = httptest.NewRecorder()
+	ok = DeleteOwnedStringKeys(c, w, newRequest("DELETE", "/", nil),
+		"Item", []string{alice.Encode()})
+	h.ErrorNotEqual("delete alice", ok, true)
+
+	err = c.GetMulti([]*datastore.Key{alice}, items[:1])
+	h.ErrorNil("alice deleted", err)
+}
@@ -0,0 +1,82 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// DefaultPageSize is the number of results in a page when no other
+// limit is given.
+const DefaultPageSize = 20
+
+// ErrBadCursor is sent when a request has a malformed cursor.
+var ErrBadCursor = RegisterError(&Error{
+	Code:     "badcursor",
+	Status:   http.StatusBadRequest,
+	Message:  "Invalid cursor.",
+	Severity: "error",
+})
+
+// Page is the JSON response for a page of entities. Keys[i] is the
+// encoded key of Items[i]. Cursor is where the next page starts and
+// is empty on the last page.
+type Page struct {
+	Items  interface{} `json:",omitempty"`
+	Keys   []string
+	Cursor string `json:",omitempty"`
+}
+
+// WritePage runs the query and sends a Page of its results with
+// WriteData. At most limit results are sent, though the request can
+// ask for fewer with the "limit" query parameter. The page starts at
+// the cursor in the "cursor" query parameter. dst must be a pointer
+// to a slice of structs (or pointers to them) unless q is keys only;
+// it holds the results afterwards. Failures are sent with the
+// standard error responses.
+func WritePage(c Context, w http.ResponseWriter, r *http.Request,
+	q *Query, limit int, dst interface{}) {
+
+	pq := *q
+	pq.Limit = limit
+	pq.Cursor = r.URL.Query().Get("cursor")
+
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			LogAndFailed(c, w, r, fmt.Errorf("bad limit: %q", s))
+			return
+		}
+		if n < limit {
+			pq.Limit = n
+		}
+	}
+
+	keys, cursor, err := c.GetPage(&pq, dst)
+	if err != nil {
+		LogAndError(c, w, r, DatastoreError(err))
+		return
+	}
+
+	skeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		skeys = append(skeys, key.Encode())
+	}
+
+	// Send an empty list rather than null.
+	var items interface{}
+	if !q.KeysOnly {
+		dv := reflect.ValueOf(dst).Elem()
+		if dv.IsNil() {
+			dv.Set(reflect.MakeSlice(dv.Type(), 0, 0))
+		}
+		items = dv.Interface()
+	}
+
+	WriteData(c, w, r, Page{Items: items, Keys: skeys, Cursor: cursor})
+}
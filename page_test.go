@@ -0,0 +1,175 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"encoding/json"
+	"github.com/icub3d/gorca/internal/testhelper"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// pageItem is the entity used in the pagination tests.
+type pageItem struct {
+	Name  string
+	Count int64
+}
+
+// putPageItems saves n pageItems with counts 0 to n-1.
+func putPageItems(c Context, n int) error {
+	keys := make([]*datastore.Key, 0, n)
+	items := make([]*pageItem, 0, n)
+	for x := 0; x < n; x++ {
+		keys = append(keys, c.NewKey("Item", "", 0, nil))
+		items = append(items, &pageItem{"item", int64(x)})
+	}
+
+	_, err := c.PutMulti(keys, items)
+	return err
+}
+
+func TestWritePage(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	h.FatalNotNil("put items", putPageItems(c, 5))
+
+	q := &Query{Kind: "Item", Orders: []string{"Count"}}
+
+	// Follow the cursors until we run out of pages.
+	var counts []int64
+	cursor := ""
+	for pages := 0; pages < 5; pages++ {
+		h.SetIndex(pages)
+
+		u := "/items?limit=2&cursor=" + url.QueryEscape(cursor)
+		r, err := http.NewRequest("GET", u, nil)
+		h.FatalNotNil("creating request", err)
+		w := httptest.NewRecorder()
+
+		var items []*pageItem
+		WritePage(c, w, r, q, 10, &items)
+		h.FatalNotEqual("response code", w.Code, http.StatusOK)
+
+		var page struct {
+			Items  []pageItem
+			Keys   []string
+			Cursor string
+		}
+		err = json.Unmarshal(w.Body.Bytes(), &page)
+		h.FatalNotNil("unmarshal", err)
+		h.ErrorNotEqual("number of keys", len(page.Keys), len(page.Items))
+
+		for _, item := range page.Items {
+			counts = append(counts, item.Count)
+		}
+
+		cursor = page.Cursor
+		if cursor == "" {
+			break
+		}
+	}
+
+	h.ErrorNotEqual("counts", counts, []int64{0, 1, 2, 3, 4})
+}
+
+func TestWritePageErrors(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	h.FatalNotNil("put items", putPageItems(c, 1))
+
+	tests := []struct {
+		url   string
+		ecode int
+		ebody string
+	}{
+		// An empty kind should give an empty list.
+		{
+			url:   "/other",
+			ecode: http.StatusOK,
+			ebody: `{"Items":[],"Keys":[]}`,
+		},
+
+		// A bad cursor.
+		{
+			url:   "/other?cursor=bad",
+			ecode: http.StatusBadRequest,
+			ebody: `{"Type":"error","Message":"Invalid cursor."}`,
+		},
+
+		// A bad limit.
+		{
+			url:   "/other?limit=none",
+			ecode: http.StatusBadRequest,
+			ebody: `{"Type":"error","Message":"Failed."}`,
+		},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		r, err := http.NewRequest("GET", test.url, nil)
+		h.FatalNotNil("creating request", err)
+		w := httptest.NewRecorder()
+
+		var items []*pageItem
+		WritePage(c, w, r, &Query{Kind: "Other"}, 10, &items)
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+	}
+}
+
+func TestStandaloneContextQuery(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	h.FatalNotNil("put items", putPageItems(c, 5))
+
+	tests := []struct {
+		q        *Query
+		expected []int64
+	}{
+		// Descending order.
+		{
+			q:        &Query{Kind: "Item", Orders: []string{"-Count"}},
+			expected: []int64{4, 3, 2, 1, 0},
+		},
+
+		// A range of values.
+		{
+			q: &Query{Kind: "Item", Orders: []string{"Count"},
+				Filters: []Filter{
+					{"Count", ">", 1},
+					{"Count", "<=", 3},
+				}},
+			expected: []int64{2, 3},
+		},
+
+		// Equality and a limit.
+		{
+			q: &Query{Kind: "Item", Orders: []string{"Count"}, Limit: 2,
+				Filters: []Filter{{"Name", "=", "item"}}},
+			expected: []int64{0, 1},
+		},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		var items []*pageItem
+		_, err := c.GetAll(test.q, &items)
+		h.FatalNotNil("get all", err)
+
+		counts := make([]int64, 0, len(items))
+		for _, item := range items {
+			counts = append(counts, item.Count)
+		}
+		h.ErrorNotEqual("counts", counts, test.expected)
+	}
+}
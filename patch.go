@@ -0,0 +1,145 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"google.golang.org/appengine/datastore"
+	"mime"
+	"net/http"
+	"reflect"
+)
+
+// These are the media types of the patches PatchKeyOrFail applies.
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+// PatchStringKeyOrFail is a helper function that converts the given
+// string into a datastore key and then calls PatchKeyOrFail with
+// it. If a failure occured, false is returned and a response was
+// returned to the request. In either case, this should be terminal.
+func PatchStringKeyOrFail(c Context, w http.ResponseWriter,
+	r *http.Request, key string, v interface{}) bool {
+
+	k, ok := StringToKey(c, w, r, key)
+	if !ok {
+		return false
+	}
+
+	return PatchKeyOrFail(c, w, r, k, v)
+}
+
+// PatchKeyOrFail is a helper function that applies the patch in the
+// request body to the entity for the given key. The body is an RFC
+// 7396 merge patch if the Content-Type is MergePatchType or an RFC
+// 6902 JSON Patch if it is JSONPatchType. Other types get a 415. The
+// entity is loaded into v, which must be a pointer to a struct,
+// patched, validated (see Validate), and saved in a transaction (see
+// RunInTransactionOrFail). The updated entity is sent as an Entity
+// with WriteData. A patch that can't be applied gets a 422. If a
+// failure occured, false is returned and a response was returned to
+// the request. In either case, this should be terminal.
+func PatchKeyOrFail(c Context, w http.ResponseWriter, r *http.Request,
+	key *datastore.Key, v interface{}) bool {
+
+	apply, ok := patchFunc(c, w, r)
+	if !ok {
+		return false
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		LogAndUnexpected(c, w, r, fmt.Errorf("can't patch a %T", v))
+		return false
+	}
+
+	// The transaction may run more than once, so v is reset each time.
+	keys := []*datastore.Key{key}
+	dst := reflect.MakeSlice(reflect.SliceOf(rv.Type()), 1, 1)
+	dst.Index(0).Set(rv)
+	fn := func(tc Context) error {
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+		if err := tc.GetMulti(keys, dst.Interface()); err != nil {
+			return err
+		}
+
+		doc, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		doc, err = apply(doc)
+		if err != nil {
+			return ErrInvalid.Wrap(err)
+		}
+
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+		if err := unmarshalJSON(doc, v); err != nil {
+			return ErrInvalid.Wrap(err)
+		}
+		if err := Validate(v); err != nil {
+			var fields ValidationError
+			if errors.As(err, &fields) {
+				return ErrInvalid.Wrap(err)
+			}
+			return err
+		}
+
+		_, err = tc.PutMulti(keys, dst.Interface())
+		return err
+	}
+
+	if !RunInTransactionOrFail(c, w, r, fn, nil) {
+		return false
+	}
+
+	WriteData(c, w, r, Entity{Key: key.Encode(), Value: v})
+	return true
+}
+
+// patchFunc reads the patch in the request body and returns a
+// function that applies it to a JSON document. If a failure occured,
+// false is returned and a response was returned to the request.
+func patchFunc(c Context, w http.ResponseWriter,
+	r *http.Request) (func([]byte) ([]byte, error), bool) {
+
+	ctype := r.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	if err != nil || (mediaType != MergePatchType &&
+		mediaType != JSONPatchType) {
+
+		LogAndError(c, w, r, ErrUnsupportedMediaType.Wrap(
+			fmt.Errorf("not a patch: %q", ctype)))
+		return nil, false
+	}
+
+	body, ok := GetBodyOrFail(c, w, r)
+	if !ok {
+		return nil, false
+	}
+
+	if mediaType == MergePatchType {
+		if !json.Valid(body) {
+			LogAndFailed(c, w, r, fmt.Errorf("invalid merge patch"))
+			return nil, false
+		}
+
+		return func(doc []byte) ([]byte, error) {
+			return jsonpatch.MergePatch(doc, body)
+		}, true
+	}
+
+	patch, err := jsonpatch.DecodePatch(body)
+	if err != nil {
+		LogAndFailed(c, w, r, err)
+		return nil, false
+	}
+
+	return patch.Apply, true
+}
@@ -0,0 +1,154 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"encoding/json"
+	"github.com/icub3d/gorca/internal/testhelper"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// patchItem is the entity patched in the tests.
+type patchItem struct {
+	Name  string `validate:"required"`
+	Count int64
+	Tags  []string
+}
+
+func TestPatchStringKeyOrFail(t *testing.T) {
+	h := testhelper.New(t)
+
+	tests := []struct {
+		key      string
+		ctype    string
+		body     string
+		result   bool
+		ecode    int
+		ebody    string
+		expected patchItem
+	}{
+		// A merge patch.
+		{
+			ctype:    MergePatchType,
+			body:     `{"Count":5,"Tags":["a"]}`,
+			result:   true,
+			ecode:    http.StatusOK,
+			expected: patchItem{"milk", 5, []string{"a"}},
+		},
+
+		// A merge patch that makes the entity invalid.
+		{
+			ctype: MergePatchType,
+			body:  `{"Name":null}`,
+			ecode: http.StatusUnprocessableEntity,
+			ebody: `{"Type":"error","Message":"Invalid.","Fields":` +
+				`[{"Field":"Name","Reason":"is required"}]}`,
+			expected: patchItem{"milk", 1, []string{"x", "y"}},
+		},
+
+		// A JSON patch.
+		{
+			ctype: JSONPatchType + "; charset=utf-8",
+			body: `[{"op":"replace","path":"/Name","value":"eggs"},` +
+				`{"op":"add","path":"/Tags/-","value":"z"}]`,
+			result:   true,
+			ecode:    http.StatusOK,
+			expected: patchItem{"eggs", 1, []string{"x", "y", "z"}},
+		},
+
+		// A JSON patch whose test fails.
+		{
+			ctype: JSONPatchType,
+			body: `[{"op":"test","path":"/Name","value":"eggs"},` +
+				`{"op":"replace","path":"/Count","value":2}]`,
+			ecode:    http.StatusUnprocessableEntity,
+			ebody:    `{"Type":"error","Message":"Invalid."}`,
+			expected: patchItem{"milk", 1, []string{"x", "y"}},
+		},
+
+		// A malformed JSON patch.
+		{
+			ctype:    JSONPatchType,
+			body:     `{"op":"remove"}`,
+			ecode:    http.StatusBadRequest,
+			ebody:    `{"Type":"error","Message":"Failed."}`,
+			expected: patchItem{"milk", 1, []string{"x", "y"}},
+		},
+
+		// A malformed merge patch.
+		{
+			ctype:    MergePatchType,
+			body:     `{"Count":`,
+			ecode:    http.StatusBadRequest,
+			ebody:    `{"Type":"error","Message":"Failed."}`,
+			expected: patchItem{"milk", 1, []string{"x", "y"}},
+		},
+
+		// Not a patch.
+		{
+			ctype:    "application/json",
+			body:     `{"Count":5}`,
+			ecode:    http.StatusUnsupportedMediaType,
+			ebody:    `{"Type":"error","Message":"Unsupported media type."}`,
+			expected: patchItem{"milk", 1, []string{"x", "y"}},
+		},
+
+		// A missing entity.
+		{
+			key:      "missing",
+			ctype:    MergePatchType,
+			body:     `{"Count":5}`,
+			ecode:    http.StatusNotFound,
+			ebody:    `{"Type":"error","Message":"Not found."}`,
+			expected: patchItem{"milk", 1, []string{"x", "y"}},
+		},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		c := NewStandaloneContext()
+		key := c.NewKey("Item", "milk", 0, nil)
+		_, err := c.PutMulti([]*datastore.Key{key},
+			[]*patchItem{&patchItem{"milk", 1, []string{"x", "y"}}})
+		h.FatalNotNil("put", err)
+
+		skey := key.Encode()
+		if test.key != "" {
+			skey = c.NewKey("Item", test.key, 0, nil).Encode()
+		}
+
+		r, err := http.NewRequest("PATCH", "/items/"+skey,
+			strings.NewReader(test.body))
+		h.FatalNotNil("creating request", err)
+		r.Header.Set("Content-Type", test.ctype)
+		w := httptest.NewRecorder()
+
+		var v patchItem
+		result := PatchStringKeyOrFail(c, w, r, skey, &v)
+		h.ErrorNotEqual("result", result, test.result)
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+
+		if test.result {
+			var e struct {
+				Key   string
+				Value patchItem
+			}
+			h.FatalNotNil("unmarshal", json.Unmarshal(w.Body.Bytes(), &e))
+			h.ErrorNotEqual("response key", e.Key, skey)
+			h.ErrorNotEqual("response value", e.Value, test.expected)
+		} else {
+			h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+		}
+
+		stored := make([]patchItem, 1)
+		h.FatalNotNil("get", c.GetMulti([]*datastore.Key{key}, stored))
+		h.ErrorNotEqual("stored", stored[0], test.expected)
+	}
+}
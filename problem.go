@@ -0,0 +1,93 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// ProblemDetails turns on RFC 7807 problem details. When it is true,
+// the error responses (status codes of 400 and above) written by
+// WriteMessage, and therefore by LogAndMessage and the LogAnd*
+// functions, are application/problem+json documents instead of a
+// Message.
+var ProblemDetails bool = false
+
+// ProblemTypeBase is the URI the problem types are made from. A slug
+// of the status text (e.g. "not-found") is appended to it. If it is
+// empty, the type of every problem is "about:blank".
+var ProblemTypeBase string = ""
+
+// Problem is an RFC 7807 problem details response.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	// Code is the code of the registered Error the problem was made
+	// from, if any. It is an extension member.
+	Code string `json:"code,omitempty"`
+
+	// Fields lists the invalid fields when the request failed
+	// validation. It is an extension member.
+	Fields []FieldError `json:"fields,omitempty"`
+
+	// Version is the current version of the entity when a versioned
+	// put conflicted. It is an extension member.
+	Version *int64 `json:"version,omitempty"`
+}
+
+// NewProblem makes a Problem for the given request with the given
+// status code and detail message. The instance is the path of the
+// request.
+func NewProblem(r *http.Request, code int, detail string) *Problem {
+	return &Problem{
+		Type:     problemType(code),
+		Title:    http.StatusText(code),
+		Status:   code,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	}
+}
+
+// problemType makes the type URI for the given status code.
+func problemType(code int) string {
+	if ProblemTypeBase == "" {
+		return "about:blank"
+	}
+
+	slug := strings.Map(func(r rune) rune {
+		switch {
+		case r == ' ' || r == '-':
+			return '-'
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, http.StatusText(code))
+
+	return ProblemTypeBase + slug
+}
+
+// WriteProblem writes the given problem as an application/problem+json
+// response.
+func WriteProblem(c Context, w http.ResponseWriter, r *http.Request,
+	p *Problem) {
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		// Eeek! just return the detail itself.
+		http.Error(w, p.Detail, p.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	writeResponse(c, w, r, b, p.Status)
+}
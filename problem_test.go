@@ -0,0 +1,101 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"fmt"
+	"github.com/icub3d/gorca/internal/testhelper"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProblemDetails(t *testing.T) {
+	h := testhelper.New(t)
+
+	// Turn on problem details for this test only.
+	ProblemDetails = true
+	defer func() {
+		ProblemDetails = false
+		ProblemTypeBase = ""
+	}()
+
+	tests := []struct {
+		f     LogAndFunc
+		fn    string
+		base  string
+		url   string
+		ecode int
+		ebody string
+		etype string
+	}{
+		// LogAndNotFound without a type base.
+		{
+			f:     LogAndNotFound,
+			fn:    "LogAndNotFound",
+			base:  "",
+			url:   "/items/123",
+			ecode: http.StatusNotFound,
+			ebody: `{"type":"about:blank","title":"Not Found","status":404,"detail":"Not found.","instance":"/items/123","code":"notfound"}`,
+			etype: "application/problem+json",
+		},
+
+		// LogAndFailed with a type base.
+		{
+			f:     LogAndFailed,
+			fn:    "LogAndFailed",
+			base:  "https://example.com/problems/",
+			url:   "/items?q=1",
+			ecode: http.StatusBadRequest,
+			ebody: `{"type":"https://example.com/problems/bad-request","title":"Bad Request","status":400,"detail":"Failed.","instance":"/items","code":"failed"}`,
+			etype: "application/problem+json",
+		},
+
+		// LogAndUnexpected with a type base.
+		{
+			f:     LogAndUnexpected,
+			fn:    "LogAndUnexpected",
+			base:  "https://example.com/problems/",
+			url:   "/",
+			ecode: http.StatusInternalServerError,
+			ebody: `{"type":"https://example.com/problems/internal-server-error","title":"Internal Server Error","status":500,"detail":"Something unexpected happened.","instance":"/","code":"unexpected"}`,
+			etype: "application/problem+json",
+		},
+	}
+
+	c := NewStandaloneContext()
+
+	for i, test := range tests {
+		h.SetIndex(i)
+		ProblemTypeBase = test.base
+
+		// Make the request and writer.
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", test.url, nil)
+		h.FatalNotNil("creating request", err)
+
+		h.SetFunc(`%s(c, w, r, err("oops"))`, test.fn)
+
+		// Call the test function
+		test.f(c, w, r, fmt.Errorf("oops"))
+
+		// Check the values.
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+		h.ErrorNotEqual("content type", w.Header().Get("Content-Type"),
+			test.etype)
+	}
+
+	// Success messages are still a Message.
+	h.SetIndex(len(tests))
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/", nil)
+	h.FatalNotNil("creating request", err)
+
+	WriteSuccessMessage(c, w, r)
+	h.ErrorNotEqual("response code", w.Code, http.StatusOK)
+	h.ErrorNotEqual("response body", w.Body.String(),
+		`{"Type":"success","Message":"Success."}`)
+}
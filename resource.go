@@ -0,0 +1,468 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// ErrMethodNotAllowed is sent when a Resource gets a request with a
+// method it doesn't serve.
+var ErrMethodNotAllowed = RegisterError(&Error{
+	Code:     "methodnotallowed",
+	Status:   http.StatusMethodNotAllowed,
+	Message:  "Method not allowed.",
+	Severity: "error",
+})
+
+// Entity is the JSON response for a single entity served by a
+// Resource.
+type Entity struct {
+	Key   string
+	Value interface{}
+}
+
+// Resource serves the entities of a datastore kind over HTTP. The
+// collection is served at Prefix and each entity at Prefix followed by
+// its encoded key:
+//
+//	GET    Prefix        lists the entities a page at a time.
+//	POST   Prefix        creates an entity from the body.
+//	GET    Prefix + key  gets the entity.
+//	PUT    Prefix + key  replaces the entity with the body.
+//	PATCH  Prefix + key  updates the fields of the entity in the body.
+//	DELETE Prefix + key  deletes the entity.
+//
+// Bodies are unmarshalled and validated with UnmarshalFromBodyOrFail
+// and responses are sent with WriteData. Writes with an If-Match
+// header are checked against the ETag of the stored entity in the
+// transaction they are saved in (see CheckIfMatch). Failures are sent
+// with the standard error responses. Resources must be made with
+// NewResource.
+type Resource struct {
+	// Kind is the datastore kind of the entities.
+	Kind string
+
+	// Prefix is the URL path the resource is served under
+	// (e.g. "/items/").
+	Prefix string
+
+	// PageSize is the most entities listed at a time. If it is zero,
+	// DefaultPageSize is used. See WritePage.
+	PageSize int
+
+	// NewContext makes the Context for a request. If it is nil, the
+	// package NewContext is used.
+	NewContext func(r *http.Request) Context
+
+	// Owned, if true, makes each entity belong to the principal that
+	// created it (see currentPrincipal). New entities are made under
+	// their OwnerKey, only their own entities are listed, and the
+	// requests for someone else's entities get a 404 (see
+	// checkOwner). Requests without a principal get a 401.
+	Owned bool
+
+	// Authorize, if not nil, is called before every request. The key
+	// is nil for requests to the collection. If it returns an error,
+	// it is sent with LogAndError, so it should usually be (or wrap)
+	// ErrUnauthorized.
+	Authorize func(c Context, r *http.Request, key *datastore.Key) error
+
+	// BeforeSave, if not nil, is called with the key and a pointer to
+	// the entity before it is saved by a POST, PUT or PATCH. It may
+	// change the entity. If it returns an error, it is sent with
+	// LogAndError and the entity is not saved. For a PATCH, it is
+	// called in the transaction with its Context and may be called
+	// more than once.
+	BeforeSave func(c Context, r *http.Request, key *datastore.Key,
+		v interface{}) error
+
+	// AfterSave, if not nil, is called with the key and a pointer to
+	// the entity after it is saved. If it returns an error, it is
+	// sent with LogAndError.
+	AfterSave func(c Context, r *http.Request, key *datastore.Key,
+		v interface{}) error
+
+	// typ is the struct type of the entities.
+	typ reflect.Type
+}
+
+// NewResource makes a Resource for the given kind served under the
+// given prefix. The entities have the type of v, which should be a
+// struct or a pointer to one.
+func NewResource(kind, prefix string, v interface{}) *Resource {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return &Resource{Kind: kind, Prefix: prefix, typ: t}
+}
+
+// ServeHTTP implements http.Handler.
+func (res *Resource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := contextFor(res.NewContext, r)
+
+	// A Resource made without NewResource doesn't know its type.
+	if res.typ == nil {
+		LogAndUnexpected(c, w, r, fmt.Errorf("resource for %s wasn't "+
+			"made with NewResource", res.Kind))
+		return
+	}
+
+	// Figure out if we are dealing with the collection or an entity.
+	skey, ok := splitPrefix(r.URL.Path, res.Prefix)
+	if !ok {
+		LogAndNotFound(c, w, r, fmt.Errorf("%s not in %s", r.URL.Path,
+			res.Prefix))
+		return
+	}
+
+	if skey == "" {
+		res.serveCollection(c, w, r)
+		return
+	}
+
+	key, ok := StringToKey(c, w, r, skey)
+	if !ok {
+		return
+	}
+	if key.Kind() != res.Kind {
+		LogAndNotFound(c, w, r, fmt.Errorf("key %v is not a %s", key,
+			res.Kind))
+		return
+	}
+	if res.Owned {
+		err := checkOwner(c, r, res.Kind, []*datastore.Key{key})
+		if err != nil {
+			LogAndError(c, w, r, err)
+			return
+		}
+	}
+
+	res.serveEntity(c, w, r, key)
+}
+
+// serveCollection handles the requests for the collection.
+func (res *Resource) serveCollection(c Context, w http.ResponseWriter,
+	r *http.Request) {
+
+	switch r.Method {
+	case "GET", "POST":
+		if !res.authorize(c, w, r, nil) {
+			return
+		}
+
+	default:
+		notAllowed(c, w, r, "GET, POST")
+		return
+	}
+
+	parent, ok := res.parent(c, w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		res.list(c, w, r, parent)
+
+	case "POST":
+		v := reflect.New(res.typ).Interface()
+		if !UnmarshalFromBodyOrFail(c, w, r, v) {
+			return
+		}
+
+		skey, key, ok := NewKey(c, w, r, res.Kind, parent)
+		if !ok {
+			return
+		}
+		if !res.save(c, w, r, key, v) {
+			return
+		}
+
+		w.Header().Set("Location", res.Prefix+skey)
+		writeData(c, w, r, Entity{Key: skey, Value: v}, http.StatusCreated)
+	}
+}
+
+// parent returns the parent of the entities in the collection: the
+// OwnerKey of the current principal if the resource is Owned and nil
+// otherwise. If no one is logged in to an Owned resource, false is
+// returned and a response was returned to the request.
+func (res *Resource) parent(c Context, w http.ResponseWriter,
+	r *http.Request) (*datastore.Key, bool) {
+
+	if !res.Owned {
+		return nil, true
+	}
+
+	p := currentPrincipal(c, r)
+	if p == nil {
+		LogAndError(c, w, r, ErrUnauthenticated.Wrap(fmt.Errorf("no "+
+			"user found, but %s entities are owned", res.Kind)))
+		return nil, false
+	}
+
+	return OwnerKey(c, p), true
+}
+
+// serveEntity handles the requests for a single entity.
+func (res *Resource) serveEntity(c Context, w http.ResponseWriter,
+	r *http.Request, key *datastore.Key) {
+
+	switch r.Method {
+	case "GET", "PUT", "PATCH", "DELETE":
+		if !res.authorize(c, w, r, key) {
+			return
+		}
+
+	default:
+		notAllowed(c, w, r, "GET, PUT, PATCH, DELETE")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		v, ok := res.get(c, w, r, key)
+		if !ok {
+			return
+		}
+		WriteData(c, w, r, Entity{Key: key.Encode(), Value: v})
+
+	case "PUT":
+		v := reflect.New(res.typ).Interface()
+		if !UnmarshalFromBodyOrFail(c, w, r, v) {
+			return
+		}
+
+		// The If-Match check and the put are done in a transaction so
+		// concurrent writes can't both match.
+		fn := func(tc Context) error {
+			if err := res.ifMatch(tc, r, key); err != nil {
+				return err
+			}
+			return res.put(tc, r, key, v)
+		}
+		if !RunInTransactionOrFail(c, w, r, fn, nil) {
+			return
+		}
+		if !res.afterSave(c, w, r, key, v) {
+			return
+		}
+		WriteData(c, w, r, Entity{Key: key.Encode(), Value: v})
+
+	case "PATCH":
+		unmarshal, ok := bodyUnmarshaler(c, w, r)
+		if !ok {
+			return
+		}
+
+		// Unmarshalling over the stored entity only changes the fields
+		// in the body. It is done in a transaction so concurrent
+		// patches don't lose each other's changes.
+		v := reflect.New(res.typ)
+		fn := func(tc Context) error {
+			if err := res.ifMatch(tc, r, key); err != nil {
+				return err
+			}
+
+			v.Elem().Set(reflect.Zero(res.typ))
+			if err := tc.GetMulti([]*datastore.Key{key},
+				res.slice(v.Interface())); err != nil {
+
+				return err
+			}
+			if err := unmarshal(v.Interface()); err != nil {
+				return err
+			}
+			return res.put(tc, r, key, v.Interface())
+		}
+		if !RunInTransactionOrFail(c, w, r, fn, nil) {
+			return
+		}
+		if !res.afterSave(c, w, r, key, v.Interface()) {
+			return
+		}
+		WriteData(c, w, r, Entity{Key: key.Encode(), Value: v.Interface()})
+
+	case "DELETE":
+		if r.Header.Get("If-Match") == "" {
+			if !DeleteKeys(c, w, r, []*datastore.Key{key}) {
+				return
+			}
+			WriteSuccessMessage(c, w, r)
+			return
+		}
+
+		fn := func(tc Context) error {
+			if err := res.ifMatch(tc, r, key); err != nil {
+				return err
+			}
+			return tc.DeleteMulti([]*datastore.Key{key})
+		}
+		if !RunInTransactionOrFail(c, w, r, fn, nil) {
+			return
+		}
+		WriteSuccessMessage(c, w, r)
+	}
+}
+
+// list sends a page of the entities of the kind. If parent isn't nil,
+// only its descendants are listed.
+func (res *Resource) list(c Context, w http.ResponseWriter,
+	r *http.Request, parent *datastore.Key) {
+
+	limit := res.PageSize
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+
+	items := reflect.New(reflect.SliceOf(reflect.PtrTo(res.typ)))
+	WritePage(c, w, r, &Query{Kind: res.Kind, Ancestor: parent}, limit,
+		items.Interface())
+}
+
+// get loads the entity for the given key. If a failure occured,
+// false is returned and a response was returned to the request.
+func (res *Resource) get(c Context, w http.ResponseWriter,
+	r *http.Request, key *datastore.Key) (interface{}, bool) {
+
+	dst := reflect.MakeSlice(reflect.SliceOf(reflect.PtrTo(res.typ)), 1, 1)
+	if !GetKeys(c, w, r, []*datastore.Key{key}, dst.Interface()) {
+		return nil, false
+	}
+
+	return dst.Index(0).Interface(), true
+}
+
+// save calls the hooks around saving the entity. If a failure
+// occured, false is returned and a response was returned to the
+// request.
+func (res *Resource) save(c Context, w http.ResponseWriter,
+	r *http.Request, key *datastore.Key, v interface{}) bool {
+
+	if err := res.put(c, r, key, v); err != nil {
+		LogAndError(c, w, r, DatastoreError(err))
+		return false
+	}
+
+	return res.afterSave(c, w, r, key, v)
+}
+
+// put calls the BeforeSave hook and then stores the entity with the
+// given Context, which may be a transaction's.
+func (res *Resource) put(c Context, r *http.Request, key *datastore.Key,
+	v interface{}) error {
+
+	if res.BeforeSave != nil {
+		if err := res.BeforeSave(c, r, key, v); err != nil {
+			return err
+		}
+	}
+
+	_, err := c.PutMulti([]*datastore.Key{key}, res.slice(v))
+	return err
+}
+
+// afterSave calls the AfterSave hook. If it fails, false is returned
+// and a response was returned to the request.
+func (res *Resource) afterSave(c Context, w http.ResponseWriter,
+	r *http.Request, key *datastore.Key, v interface{}) bool {
+
+	if res.AfterSave == nil {
+		return true
+	}
+
+	if err := res.AfterSave(c, r, key, v); err != nil {
+		LogAndError(c, w, r, err)
+		return false
+	}
+
+	return true
+}
+
+// slice returns a slice holding just v, a pointer to an entity, for
+// the multi datastore calls.
+func (res *Resource) slice(v interface{}) interface{} {
+	s := reflect.MakeSlice(reflect.SliceOf(reflect.PtrTo(res.typ)), 1, 1)
+	s.Index(0).Set(reflect.ValueOf(v))
+	return s.Interface()
+}
+
+// authorize calls the Authorize hook. If it fails, false is returned
+// and a response was returned to the request.
+func (res *Resource) authorize(c Context, w http.ResponseWriter,
+	r *http.Request, key *datastore.Key) bool {
+
+	if res.Authorize == nil {
+		return true
+	}
+
+	if err := res.Authorize(c, r, key); err != nil {
+		LogAndError(c, w, r, err)
+		return false
+	}
+
+	return true
+}
+
+// ifMatch checks the If-Match header against the stored entity with
+// the given Context, which should be the transaction's the entity is
+// saved in. A missing entity never matches.
+func (res *Resource) ifMatch(c Context, r *http.Request,
+	key *datastore.Key) error {
+
+	if r.Header.Get("If-Match") == "" {
+		return nil
+	}
+
+	v := reflect.New(res.typ).Interface()
+	err := c.GetMulti([]*datastore.Key{key}, res.slice(v))
+	if err != nil {
+		err = DatastoreError(err)
+		if errors.Is(err, ErrNotFound) {
+			err = ErrPreconditionFailed.Wrap(err)
+		}
+		return err
+	}
+
+	return CheckIfMatch(r, Entity{Key: key.Encode(), Value: v})
+}
+
+// notAllowed sends a 405 with the allowed methods.
+func notAllowed(c Context, w http.ResponseWriter,
+	r *http.Request, allow string) {
+
+	w.Header().Set("Allow", allow)
+	LogAndError(c, w, r, ErrMethodNotAllowed.Wrap(
+		fmt.Errorf("%s %s", r.Method, r.URL.Path)))
+}
+
+// splitPrefix returns the key in a path served under the prefix. The
+// key is empty for the prefix itself, with or without its trailing
+// slash. If the path isn't under the prefix or has more than one
+// segment after it, false is returned.
+func splitPrefix(path, prefix string) (string, bool) {
+	if path+"/" == prefix {
+		return "", true
+	}
+
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+
+	skey := strings.TrimPrefix(path, prefix)
+	if strings.Contains(skey, "/") {
+		return "", false
+	}
+
+	return skey, true
+}
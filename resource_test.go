@@ -0,0 +1,482 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/icub3d/gorca/internal/testhelper"
+	"google.golang.org/appengine/datastore"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// resourceItem is the entity served in the resource tests.
+type resourceItem struct {
+	Name  string `validate:"required"`
+	Count int64
+	Saved bool
+}
+
+func TestResource(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+
+	res := NewResource("Item", "/items/", resourceItem{})
+	res.NewContext = func(r *http.Request) Context { return c }
+	res.BeforeSave = func(c Context, r *http.Request, key *datastore.Key,
+		v interface{}) error {
+
+		v.(*resourceItem).Saved = true
+		return nil
+	}
+	res.Authorize = func(c Context, r *http.Request,
+		key *datastore.Key) error {
+
+		if r.Header.Get("X-Forbidden") != "" {
+			return ErrUnauthorized
+		}
+		return nil
+	}
+
+	// serve is a helper that sends a request to the resource.
+	serve := func(method, url, body string) *httptest.ResponseRecorder {
+		var b io.Reader
+		if body != "" {
+			b = strings.NewReader(body)
+		}
+		r, err := http.NewRequest(method, url, b)
+		h.FatalNotNil("creating request", err)
+		if strings.Contains(body, "forbidden") {
+			r.Header.Set("X-Forbidden", "yes")
+		}
+
+		w := httptest.NewRecorder()
+		res.ServeHTTP(w, r)
+		return w
+	}
+
+	// Create an item.
+	h.SetFunc("POST /items/")
+	w := serve("POST", "/items/", `{"Name":"milk","Count":1}`)
+	h.FatalNotEqual("response code", w.Code, http.StatusCreated)
+
+	var created struct {
+		Key   string
+		Value resourceItem
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &created)
+	h.FatalNotNil("unmarshal", err)
+	h.ErrorNotEqual("created value", created.Value,
+		resourceItem{Name: "milk", Count: 1, Saved: true})
+	h.ErrorNotEqual("location", w.Header().Get("Location"),
+		"/items/"+created.Key)
+
+	url := "/items/" + created.Key
+	other := c.NewKey("Other", "", 1, nil).Encode()
+
+	tests := []struct {
+		method string
+		url    string
+		body   string
+		ecode  int
+		ebody  string
+	}{
+		// Get the item.
+		{
+			method: "GET",
+			url:    url,
+			ecode:  http.StatusOK,
+			ebody: fmt.Sprintf(`{"Key":"%s","Value":{"Name":"milk",`+
+				`"Count":1,"Saved":true}}`, created.Key),
+		},
+
+		// Patch the count.
+		{
+			method: "PATCH",
+			url:    url,
+			body:   `{"Count":2}`,
+			ecode:  http.StatusOK,
+			ebody: fmt.Sprintf(`{"Key":"%s","Value":{"Name":"milk",`+
+				`"Count":2,"Saved":true}}`, created.Key),
+		},
+
+		// Put an invalid item.
+		{
+			method: "PUT",
+			url:    url,
+			body:   `{"Count":3}`,
+			ecode:  http.StatusUnprocessableEntity,
+			ebody: `{"Type":"error","Message":"Invalid.","Fields":` +
+				`[{"Field":"Name","Reason":"is required"}]}`,
+		},
+
+		// Put a new item.
+		{
+			method: "PUT",
+			url:    url,
+			body:   `{"Name":"eggs","Count":12}`,
+			ecode:  http.StatusOK,
+			ebody: fmt.Sprintf(`{"Key":"%s","Value":{"Name":"eggs",`+
+				`"Count":12,"Saved":true}}`, created.Key),
+		},
+
+		// List the items.
+		{
+			method: "GET",
+			url:    "/items",
+			ecode:  http.StatusOK,
+			ebody: fmt.Sprintf(`{"Items":[{"Name":"eggs","Count":12,`+
+				`"Saved":true}],"Keys":["%s"]}`, created.Key),
+		},
+
+		// Not authorized.
+		{
+			method: "PUT",
+			url:    url,
+			body:   `{"Name":"forbidden"}`,
+			ecode:  http.StatusForbidden,
+			ebody:  `{"Type":"error","Message":"You are not authorized to do that."}`,
+		},
+
+		// A key of another kind.
+		{
+			method: "GET",
+			url:    "/items/" + other,
+			ecode:  http.StatusNotFound,
+			ebody:  `{"Type":"error","Message":"Not found."}`,
+		},
+
+		// A bad key.
+		{
+			method: "GET",
+			url:    "/items/hahaha",
+			ecode:  http.StatusBadRequest,
+			ebody:  `{"Type":"error","Message":"Invalid key."}`,
+		},
+
+		// A bad method.
+		{
+			method: "POST",
+			url:    url,
+			ecode:  http.StatusMethodNotAllowed,
+			ebody:  `{"Type":"error","Message":"Method not allowed."}`,
+		},
+
+		// Delete the item.
+		{
+			method: "DELETE",
+			url:    url,
+			ecode:  http.StatusOK,
+			ebody:  `{"Type":"success","Message":"Success."}`,
+		},
+
+		// It's gone now.
+		{
+			method: "GET",
+			url:    url,
+			ecode:  http.StatusNotFound,
+			ebody:  `{"Type":"error","Message":"Not found."}`,
+		},
+	}
+
+	for i, test := range tests {
+		h.SetIndex(i)
+		h.SetFunc("%s %s", test.method, test.url)
+
+		w := serve(test.method, test.url, test.body)
+
+		// Check the values.
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+	}
+}
+
+func TestResourceIfMatch(t *testing.T) {
+	h := testhelper.New(t)
+
+	defer func(etags bool) { ETags = etags }(ETags)
+	ETags = true
+
+	c := NewStandaloneContext()
+	res := NewResource("Item", "/items/", resourceItem{})
+	res.NewContext = func(r *http.Request) Context { return c }
+
+	key := c.NewKey("Item", "milk", 0, nil)
+	_, err := c.PutMulti([]*datastore.Key{key},
+		[]*resourceItem{&resourceItem{Name: "milk", Count: 1}})
+	h.FatalNotNil("put", err)
+	url := "/items/" + key.Encode()
+
+	// serve is a helper that sends a request to the resource.
+	serve := func(method, ifMatch, body string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, url, strings.NewReader(body))
+		h.FatalNotNil("creating request", err)
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+
+		w := httptest.NewRecorder()
+		res.ServeHTTP(w, r)
+		return w
+	}
+
+	// Get the current ETag.
+	w := serve("GET", "", "")
+	h.FatalNotEqual("get", w.Code, http.StatusOK)
+	etag := w.Header().Get("ETag")
+	h.FatalNotEqual("etag", etag, ETag(w.Body.Bytes()))
+
+	// A stale ETag is rejected.
+	w = serve("PUT", `"stale"`, `{"Name":"eggs"}`)
+	h.ErrorNotEqual("stale put", w.Code, http.StatusPreconditionFailed)
+
+	// The current one works but then it is stale.
+	w = serve("PUT", etag, `{"Name":"eggs"}`)
+	h.ErrorNotEqual("current put", w.Code, http.StatusOK)
+	w = serve("PATCH", etag, `{"Count":2}`)
+	h.ErrorNotEqual("stale patch", w.Code, http.StatusPreconditionFailed)
+
+	// Of concurrent writes with the same ETag, only one matches.
+	w = serve("GET", "", "")
+	etag = w.Header().Get("ETag")
+	codes := make(chan int, 3)
+	for _, body := range []string{`{"Name":"a"}`, `{"Name":"b"}`,
+		`{"Name":"c"}`} {
+
+		go func(body string) {
+			r := newRequest("PUT", url, strings.NewReader(body))
+			r.Header.Set("If-Match", etag)
+			w := httptest.NewRecorder()
+			res.ServeHTTP(w, r)
+			codes <- w.Code
+		}(body)
+	}
+	matched := 0
+	for x := 0; x < 3; x++ {
+		if <-codes == http.StatusOK {
+			matched++
+		}
+	}
+	h.ErrorNotEqual("concurrent puts matched", matched, 1)
+
+	// A missing entity never matches.
+	w = serve("DELETE", "*", "")
+	h.ErrorNotEqual("delete", w.Code, http.StatusOK)
+	w = serve("PUT", "*", `{"Name":"eggs"}`)
+	h.ErrorNotEqual("missing put", w.Code, http.StatusPreconditionFailed)
+}
+
+func TestResourceOwned(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	res := NewResource("Item", "/items/", resourceItem{})
+	res.NewContext = func(r *http.Request) Context { return c }
+	res.Owned = true
+
+	// serve is a helper that sends a request to the resource as the
+	// given user.
+	serve := func(email, method, url,
+		body string) *httptest.ResponseRecorder {
+
+		c.Logout()
+		if email != "" {
+			c.Login(email, false)
+		}
+
+		w := httptest.NewRecorder()
+		res.ServeHTTP(w, newRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+
+	// Alice makes an item under her owner key.
+	w := serve("alice@example.com", "POST", "/items/", `{"Name":"milk"}`)
+	h.FatalNotEqual("create", w.Code, http.StatusCreated)
+	var created Entity
+	h.FatalNotNil("unmarshal", json.Unmarshal(w.Body.Bytes(), &created))
+	key, err := datastore.DecodeKey(created.Key)
+	h.FatalNotNil("decode key", err)
+	h.ErrorNotEqual("parent", key.Parent().Equal(OwnerKey(c,
+		&Principal{Email: "alice@example.com"})), true)
+	url := "/items/" + created.Key
+
+	// An item without an owner.
+	unowned := c.NewKey("Item", "unowned", 0, nil)
+	_, err = c.PutMulti([]*datastore.Key{unowned},
+		[]*resourceItem{{Name: "unowned"}})
+	h.FatalNotNil("put", err)
+
+	tests := []struct {
+		email  string
+		method string
+		url    string
+		body   string
+		ecode  int
+	}{
+		// No one is logged in.
+		{method: "GET", url: "/items/", ecode: http.StatusUnauthorized},
+		{
+			method: "POST",
+			url:    "/items/",
+			body:   `{"Name":"eggs"}`,
+			ecode:  http.StatusUnauthorized,
+		},
+		{method: "GET", url: url, ecode: http.StatusUnauthorized},
+
+		// Alice's own item.
+		{
+			email:  "alice@example.com",
+			method: "GET",
+			url:    url,
+			ecode:  http.StatusOK,
+		},
+		{
+			email:  "alice@example.com",
+			method: "PATCH",
+			url:    url,
+			body:   `{"Count":2}`,
+			ecode:  http.StatusOK,
+		},
+
+		// Bob can't find it.
+		{
+			email:  "bob@example.com",
+			method: "GET",
+			url:    url,
+			ecode:  http.StatusNotFound,
+		},
+		{
+			email:  "bob@example.com",
+			method: "PUT",
+			url:    url,
+			body:   `{"Name":"stolen"}`,
+			ecode:  http.StatusNotFound,
+		},
+		{
+			email:  "bob@example.com",
+			method: "PATCH",
+			url:    url,
+			body:   `{"Name":"stolen"}`,
+			ecode:  http.StatusNotFound,
+		},
+		{
+			email:  "bob@example.com",
+			method: "DELETE",
+			url:    url,
+			ecode:  http.StatusNotFound,
+		},
+
+		// No one owns the unowned item.
+		{
+			email:  "alice@example.com",
+			method: "GET",
+			url:    "/items/" + unowned.Encode(),
+			ecode:  http.StatusNotFound,
+		},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+		h.SetFunc(test.method + " " + test.url)
+
+		w := serve(test.email, test.method, test.url, test.body)
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+	}
+
+	// Only their own items are listed.
+	h.SetFunc("GET /items/")
+	w = serve("bob@example.com", "GET", "/items/", "")
+	h.FatalNotEqual("bob's list", w.Code, http.StatusOK)
+	h.ErrorNotEqual("bob's list", strings.Contains(w.Body.String(),
+		"milk"), false)
+	w = serve("alice@example.com", "GET", "/items/", "")
+	h.FatalNotEqual("alice's list", w.Code, http.StatusOK)
+	h.ErrorNotEqual("alice's list", strings.Contains(w.Body.String(),
+		"milk"), true)
+	h.ErrorNotEqual("alice's list", strings.Contains(w.Body.String(),
+		"unowned"), false)
+
+	// Alice's item is unchanged by Bob.
+	items := make([]resourceItem, 1)
+	h.FatalNotNil("get", c.GetMulti([]*datastore.Key{key}, items))
+	h.ErrorNotEqual("item", items[0], resourceItem{Name: "milk", Count: 2})
+}
+
+func TestResourceWithoutType(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	res := &Resource{Kind: "Item", Prefix: "/items/",
+		NewContext: func(r *http.Request) Context { return c }}
+
+	w := httptest.NewRecorder()
+	res.ServeHTTP(w, newRequest("POST", "/items/",
+		strings.NewReader(`{"Name":"milk"}`)))
+	h.ErrorNotEqual("response code", w.Code, http.StatusInternalServerError)
+}
+
+func TestResourceConcurrentPatch(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	res := NewResource("Item", "/items/", resourceItem{})
+	res.NewContext = func(r *http.Request) Context { return c }
+
+	key := c.NewKey("Item", "", 1, nil)
+	_, err := c.PutMulti([]*datastore.Key{key},
+		[]*resourceItem{&resourceItem{Name: "milk"}})
+	h.FatalNotNil("put", err)
+	url := "/items/" + key.Encode()
+
+	// Each patch changes a different field, so none should be lost.
+	bodies := []string{`{"Name":"eggs"}`, `{"Count":12}`, `{"Saved":true}`}
+	codes := make(chan int, len(bodies))
+	for _, body := range bodies {
+		go func(body string) {
+			w := httptest.NewRecorder()
+			res.ServeHTTP(w, newRequest("PATCH", url,
+				strings.NewReader(body)))
+			codes <- w.Code
+		}(body)
+	}
+	for range bodies {
+		h.ErrorNotEqual("response code", <-codes, http.StatusOK)
+	}
+
+	items := make([]resourceItem, 1)
+	err = c.GetMulti([]*datastore.Key{key}, items)
+	h.FatalNotNil("get", err)
+	h.ErrorNotEqual("item", items[0],
+		resourceItem{Name: "eggs", Count: 12, Saved: true})
+}
+
+func TestSplitPrefix(t *testing.T) {
+	h := testhelper.New(t)
+
+	tests := []struct {
+		path string
+		skey string
+		ok   bool
+	}{
+		{path: "/items/", ok: true},
+		{path: "/items", ok: true},
+		{path: "/items/abc", skey: "abc", ok: true},
+		{path: "/items/abc/def"},
+		{path: "/other/abc"},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		skey, ok := splitPrefix(test.path, "/items/")
+		h.ErrorNotEqual("ok", ok, test.ok)
+		h.ErrorNotEqual("key", skey, test.skey)
+	}
+}
@@ -0,0 +1,1013 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// standaloneAppID is the application ID given to the keys made by a
+// StandaloneContext.
+const standaloneAppID = "standalone"
+
+// StandaloneContext is a Context that needs no App Engine
+// services. Messages are written to Logger, entities and tasks are
+// kept in memory, and the logged in user is set with Login and
+// Logout. Queued tasks are run with RunTasks. It is suited to plain
+// net/http services and unit tests.
+type StandaloneContext struct {
+	context.Context
+
+	// Logger is where the messages are written. If it is nil, the
+	// standard logger is used.
+	Logger *log.Logger
+
+	state *standaloneState
+
+	// tx is the transaction of the context given to the function
+	// passed to RunInTransaction. It is nil outside of one.
+	tx *standaloneTx
+}
+
+// standaloneTx is what a transaction has changed, so a rollback can
+// undo only that.
+type standaloneTx struct {
+	// undo has the entities, as they were before the transaction,
+	// of the keys it put or deleted. The ones that didn't exist are
+	// nil.
+	undo map[string]*standaloneEntity
+
+	// tasks are the tasks it added. They are only queued when it
+	// commits.
+	tasks []StandaloneTask
+}
+
+// record saves the entity of the key, as it was before the
+// transaction, if it hasn't been saved yet. state.mu must be held.
+func (tx *standaloneTx) record(state *standaloneState, k string) {
+	if _, ok := tx.undo[k]; ok {
+		return
+	}
+
+	if e, ok := state.entities[k]; ok {
+		tx.undo[k] = &e
+	} else {
+		tx.undo[k] = nil
+	}
+}
+
+// standaloneState is the datastore, task queue, and user shared by a
+// StandaloneContext and the copies made with WithContext.
+type standaloneState struct {
+	// txMu is held while a transaction runs. Transactions are run
+	// one at a time, so they never collide.
+	txMu sync.Mutex
+
+	mu       sync.Mutex
+	entities map[string]standaloneEntity
+	lastID   int64
+	tasks    []StandaloneTask
+	user     *user.User
+
+	// oauth is the user logged in with LoginOAuth and scopes are the
+	// scopes they were granted.
+	oauth  *user.User
+	scopes []string
+}
+
+// StandaloneTask is a task queued with a StandaloneContext.
+type StandaloneTask struct {
+	Path   string
+	Params url.Values
+	Queue  string
+}
+
+// standaloneEntity is a single entity in the in-memory datastore.
+type standaloneEntity struct {
+	key   *datastore.Key
+	props []datastore.Property
+}
+
+// NewStandaloneContext returns a new StandaloneContext with an empty
+// datastore and no one logged in. Use WithContext to give it a
+// deadline or make it cancelable.
+func NewStandaloneContext() *StandaloneContext {
+	return &StandaloneContext{
+		Context: context.Background(),
+		state: &standaloneState{
+			entities: make(map[string]standaloneEntity),
+		},
+	}
+}
+
+// WithContext returns a copy of c that uses the given context for
+// cancellation and deadlines. The copy shares its datastore and
+// current user with c.
+func (c *StandaloneContext) WithContext(
+	ctx context.Context) *StandaloneContext {
+
+	return &StandaloneContext{
+		Context: ctx,
+		Logger:  c.Logger,
+		state:   c.state,
+		tx:      c.tx,
+	}
+}
+
+// Login makes the user with the given email the current user.
+func (c *StandaloneContext) Login(email string, admin bool) {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	c.state.user = &user.User{Email: email, Admin: admin}
+}
+
+// LoginOAuth makes the user with the given email the current OAuth
+// user. They are granted the given scopes.
+func (c *StandaloneContext) LoginOAuth(email string, admin bool,
+	scopes ...string) {
+
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	c.state.oauth = &user.User{Email: email, Admin: admin}
+	c.state.scopes = append([]string{}, scopes...)
+}
+
+// Logout removes the current user and OAuth user.
+func (c *StandaloneContext) Logout() {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	c.state.user = nil
+	c.state.oauth = nil
+	c.state.scopes = nil
+}
+
+// logf writes the message to the Logger with the given priority.
+func (c *StandaloneContext) logf(priority, format string,
+	args ...interface{}) {
+
+	message := fmt.Sprintf("%s: %s", priority, fmt.Sprintf(format, args...))
+	if c.Logger != nil {
+		c.Logger.Print(message)
+		return
+	}
+
+	log.Print(message)
+}
+
+// Debugf implements Logger.
+func (c *StandaloneContext) Debugf(format string, args ...interface{}) {
+	c.logf("DEBUG", format, args...)
+}
+
+// Infof implements Logger.
+func (c *StandaloneContext) Infof(format string, args ...interface{}) {
+	c.logf("INFO", format, args...)
+}
+
+// Warningf implements Logger.
+func (c *StandaloneContext) Warningf(format string, args ...interface{}) {
+	c.logf("WARNING", format, args...)
+}
+
+// Errorf implements Logger.
+func (c *StandaloneContext) Errorf(format string, args ...interface{}) {
+	c.logf("ERROR", format, args...)
+}
+
+// Criticalf implements Logger.
+func (c *StandaloneContext) Criticalf(format string, args ...interface{}) {
+	c.logf("CRITICAL", format, args...)
+}
+
+// AllocateIDs implements Datastore. The IDs are unique across all
+// kinds. Like the other Datastore methods, it fails once the context
+// is canceled or its deadline has passed.
+func (c *StandaloneContext) AllocateIDs(kind string, parent *datastore.Key,
+	n int) (int64, int64, error) {
+
+	if err := c.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	low := c.state.lastID + 1
+	c.state.lastID += int64(n)
+
+	return low, c.state.lastID, nil
+}
+
+// gobKey has the same gob encoding as a datastore.Key. The datastore
+// package can only make keys from an App Engine context, so keys are
+// made by decoding one of these instead.
+type gobKey struct {
+	Kind      string
+	StringID  string
+	IntID     int64
+	Parent    *gobKey
+	AppID     string
+	Namespace string
+}
+
+// toGobKey converts the given key into a gobKey.
+func toGobKey(k *datastore.Key) *gobKey {
+	if k == nil {
+		return nil
+	}
+
+	return &gobKey{
+		Kind:      k.Kind(),
+		StringID:  k.StringID(),
+		IntID:     k.IntID(),
+		Parent:    toGobKey(k.Parent()),
+		AppID:     k.AppID(),
+		Namespace: k.Namespace(),
+	}
+}
+
+// NewKey implements Datastore.
+func (c *StandaloneContext) NewKey(kind, stringID string, intID int64,
+	parent *datastore.Key) *datastore.Key {
+
+	gk := &gobKey{
+		Kind:     kind,
+		StringID: stringID,
+		IntID:    intID,
+		Parent:   toGobKey(parent),
+		AppID:    standaloneAppID,
+	}
+	if parent != nil {
+		gk.AppID = parent.AppID()
+		gk.Namespace = parent.Namespace()
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(gk); err != nil {
+		panic(fmt.Sprintf("encoding key: %v", err))
+	}
+
+	key := new(datastore.Key)
+	if err := key.GobDecode(buf.Bytes()); err != nil {
+		panic(fmt.Sprintf("decoding key: %v", err))
+	}
+
+	return key
+}
+
+// GetMulti implements Datastore.
+func (c *StandaloneContext) GetMulti(keys []*datastore.Key,
+	dst interface{}) error {
+
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice {
+		return datastore.ErrInvalidEntityType
+	}
+	if v.Len() != len(keys) {
+		return fmt.Errorf("datastore: key and dst slices have different length")
+	}
+
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	errs := make(appengine.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		if key == nil || key.Incomplete() {
+			errs[i] = datastore.ErrInvalidKey
+			failed = true
+			continue
+		}
+
+		e, ok := c.state.entities[key.Encode()]
+		if !ok {
+			errs[i] = datastore.ErrNoSuchEntity
+			failed = true
+			continue
+		}
+
+		if err := loadEntity(v.Index(i), e.props); err != nil {
+			errs[i] = err
+			failed = true
+		}
+	}
+
+	if failed {
+		return errs
+	}
+
+	return nil
+}
+
+// PutMulti implements Datastore. Incomplete keys are given a new
+// ID.
+func (c *StandaloneContext) PutMulti(keys []*datastore.Key,
+	src interface{}) ([]*datastore.Key, error) {
+
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice {
+		return nil, datastore.ErrInvalidEntityType
+	}
+	if v.Len() != len(keys) {
+		return nil,
+			fmt.Errorf("datastore: key and src slices have different length")
+	}
+
+	// Convert all the values before storing any of them.
+	props := make([][]datastore.Property, len(keys))
+	for i, key := range keys {
+		if key == nil {
+			return nil, datastore.ErrInvalidKey
+		}
+
+		p, err := saveEntity(v.Index(i))
+		if err != nil {
+			return nil, err
+		}
+		props[i] = p
+	}
+
+	ret := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		if key.Incomplete() {
+			id, _, _ := c.AllocateIDs(key.Kind(), key.Parent(), 1)
+			key = c.NewKey(key.Kind(), "", id, key.Parent())
+		}
+
+		c.state.mu.Lock()
+		if c.tx != nil {
+			c.tx.record(c.state, key.Encode())
+		}
+		c.state.entities[key.Encode()] = standaloneEntity{key: key, props: props[i]}
+		c.state.mu.Unlock()
+
+		ret[i] = key
+	}
+
+	return ret, nil
+}
+
+// DeleteMulti implements Datastore.
+func (c *StandaloneContext) DeleteMulti(keys []*datastore.Key) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			return datastore.ErrInvalidKey
+		}
+	}
+
+	for _, key := range keys {
+		if c.tx != nil {
+			c.tx.record(c.state, key.Encode())
+		}
+		delete(c.state.entities, key.Encode())
+	}
+
+	return nil
+}
+
+// GetAll implements Datastore. Without any orders, the results are
+// ordered by key.
+func (c *StandaloneContext) GetAll(q *Query,
+	dst interface{}) ([]*datastore.Key, error) {
+
+	keys, _, err := c.GetPage(q, dst)
+	return keys, err
+}
+
+// GetPage implements Datastore. The cursors are offsets into the
+// results, so they may skip or repeat entities if the datastore
+// changes between pages.
+func (c *StandaloneContext) GetPage(q *Query,
+	dst interface{}) ([]*datastore.Key, string, error) {
+
+	if err := c.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var dv reflect.Value
+	if !q.KeysOnly {
+		dv = reflect.ValueOf(dst)
+		if dv.Kind() != reflect.Ptr || dv.Elem().Kind() != reflect.Slice {
+			return nil, "", datastore.ErrInvalidEntityType
+		}
+		dv = dv.Elem()
+	}
+
+	matches, offset, err := c.query(q)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Cut out the page.
+	cursor := ""
+	if q.Limit > 0 && len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+		cursor = encodeStandaloneCursor(offset + q.Limit)
+	}
+
+	keys := make([]*datastore.Key, 0, len(matches))
+	for _, e := range matches {
+		if !q.KeysOnly {
+			ev := reflect.New(dv.Type().Elem()).Elem()
+			if err := loadEntity(ev, e.props); err != nil {
+				return nil, "", err
+			}
+			dv.Set(reflect.Append(dv, ev))
+		}
+
+		keys = append(keys, e.key)
+	}
+
+	return keys, cursor, nil
+}
+
+// Run implements Datastore. The results are found when it is called,
+// so later changes to the datastore aren't seen by the Iterator.
+func (c *StandaloneContext) Run(q *Query) (Iterator, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+
+	matches, offset, err := c.query(q)
+	if err != nil {
+		return nil, err
+	}
+	if q.Limit > 0 && len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+	}
+
+	return &standaloneIterator{c: c, entities: matches, offset: offset}, nil
+}
+
+// query returns the entities matching the query, without its limit,
+// starting at its cursor. The offset of the cursor is also returned.
+func (c *StandaloneContext) query(q *Query) ([]standaloneEntity, int,
+	error) {
+
+	offset := 0
+	if q.Cursor != "" {
+		var err error
+		if offset, err = decodeStandaloneCursor(q.Cursor); err != nil {
+			return nil, 0, ErrBadCursor.Wrap(err)
+		}
+	}
+
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	// Find the matching entities.
+	matches := make([]standaloneEntity, 0)
+	for _, e := range c.state.entities {
+		if q.Kind != "" && e.key.Kind() != q.Kind {
+			continue
+		}
+		if q.Ancestor != nil && !hasAncestor(e.key, q.Ancestor) {
+			continue
+		}
+
+		ok, err := matchFilters(e.props, q.Filters)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			matches = append(matches, e)
+		}
+	}
+	sort.Sort(byOrders{matches, q.Orders})
+
+	if offset > len(matches) {
+		offset = len(matches)
+	}
+
+	return matches[offset:], offset, nil
+}
+
+// standaloneIterator is the Iterator returned by a
+// StandaloneContext.
+type standaloneIterator struct {
+	c        *StandaloneContext
+	entities []standaloneEntity
+	offset   int
+	next     int
+}
+
+// Next implements Iterator.
+func (it *standaloneIterator) Next(dst interface{}) (*datastore.Key,
+	error) {
+
+	if err := it.c.Err(); err != nil {
+		return nil, err
+	}
+	if it.next >= len(it.entities) {
+		return nil, datastore.Done
+	}
+
+	e := it.entities[it.next]
+	if dst != nil {
+		if err := loadEntity(reflect.ValueOf(dst), e.props); err != nil {
+			return nil, err
+		}
+	}
+	it.next++
+
+	return e.key, nil
+}
+
+// Cursor implements Iterator.
+func (it *standaloneIterator) Cursor() (string, error) {
+	return encodeStandaloneCursor(it.offset + it.next), nil
+}
+
+// RunInTransaction implements Datastore. Transactions are run one at
+// a time. A rollback puts back only the entities the transaction put
+// or deleted, so changes made outside of it are kept, unless they were
+// to those same entities. xg is ignored as there are no entity group
+// limits.
+func (c *StandaloneContext) RunInTransaction(fn func(tc Context) error,
+	xg bool) error {
+
+	if c.tx != nil {
+		return errors.New("datastore: nested transactions are not supported")
+	}
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	c.state.txMu.Lock()
+	defer c.state.txMu.Unlock()
+
+	tx := &standaloneTx{undo: make(map[string]*standaloneEntity)}
+	tc := &StandaloneContext{
+		Context: c.Context,
+		Logger:  c.Logger,
+		state:   c.state,
+		tx:      tx,
+	}
+	err := fn(tc)
+
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	if err != nil {
+		for k, e := range tx.undo {
+			if e == nil {
+				delete(c.state.entities, k)
+			} else {
+				c.state.entities[k] = *e
+			}
+		}
+		return err
+	}
+	c.state.tasks = append(c.state.tasks, tx.tasks...)
+
+	return nil
+}
+
+// AddTask implements TaskQueue. The task is kept until RunTasks is
+// called. Like on App Engine, tasks added in a transaction are only
+// queued once it commits.
+func (c *StandaloneContext) AddTask(path string, params url.Values,
+	queue string) error {
+
+	if err := c.Err(); err != nil {
+		return err
+	}
+
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	task := StandaloneTask{Path: path, Params: params, Queue: queue}
+	if c.tx != nil {
+		c.tx.tasks = append(c.tx.tasks, task)
+		return nil
+	}
+	c.state.tasks = append(c.state.tasks, task)
+
+	return nil
+}
+
+// Tasks returns the tasks waiting to be run.
+func (c *StandaloneContext) Tasks() []StandaloneTask {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	return append([]StandaloneTask{}, c.state.tasks...)
+}
+
+// RunTasks runs the queued tasks, including any they queue, by
+// POSTing them to h until none are left. Only these requests are
+// served by HandleCascadeDelete, even if others have the
+// X-AppEngine-QueueName header. If a task doesn't respond
+// with a 2xx status, it stays queued and an error is returned.
+func (c *StandaloneContext) RunTasks(h http.Handler) error {
+	for {
+		c.state.mu.Lock()
+		if len(c.state.tasks) == 0 {
+			c.state.mu.Unlock()
+			return nil
+		}
+		task := c.state.tasks[0]
+		c.state.tasks = c.state.tasks[1:]
+		c.state.mu.Unlock()
+
+		r, err := http.NewRequest("POST", task.Path,
+			strings.NewReader(task.Params.Encode()))
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		queue := task.Queue
+		if queue == "" {
+			queue = "default"
+		}
+		r.Header.Set(taskQueueHeader, queue)
+		r = r.WithContext(context.WithValue(r.Context(),
+			standaloneTaskKey{}, c.state))
+
+		w := &taskRecorder{header: make(http.Header)}
+		h.ServeHTTP(w, r)
+		if w.code == 0 {
+			w.code = http.StatusOK
+		}
+		if w.code < 200 || w.code > 299 {
+			c.state.mu.Lock()
+			c.state.tasks = append([]StandaloneTask{task}, c.state.tasks...)
+			c.state.mu.Unlock()
+			return fmt.Errorf("task %s failed with %d: %s", task.Path,
+				w.code, w.body.String())
+		}
+	}
+}
+
+// taskRecorder is the http.ResponseWriter a task is run with. It
+// records the status and body, so a failure can be reported.
+type taskRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+// Header implements http.ResponseWriter.
+func (w *taskRecorder) Header() http.Header {
+	return w.header
+}
+
+// Write implements http.ResponseWriter.
+func (w *taskRecorder) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+
+	return w.body.Write(b)
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *taskRecorder) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+// CurrentUser implements Users.
+func (c *StandaloneContext) CurrentUser() *user.User {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	return c.state.user
+}
+
+// CurrentOAuthUser implements Users. It returns the user set with
+// LoginOAuth if they were granted all of the scopes.
+func (c *StandaloneContext) CurrentOAuthUser(scopes ...string) (*user.User,
+	error) {
+
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	if c.state.oauth == nil {
+		return nil, errors.New("oauth: no token")
+	}
+
+	granted := make(map[string]bool)
+	for _, s := range c.state.scopes {
+		granted[s] = true
+	}
+	for _, s := range scopes {
+		if !granted[s] {
+			return nil, fmt.Errorf("oauth: scope %q not granted", s)
+		}
+	}
+
+	return c.state.oauth, nil
+}
+
+// LoginURL implements Users. The URL mimics the one given by the
+// development server.
+func (c *StandaloneContext) LoginURL(dest string) (string, error) {
+	return "/_ah/login?continue=" + url.QueryEscape(dest), nil
+}
+
+// LogoutURL implements Users. The URL mimics the one given by the
+// development server.
+func (c *StandaloneContext) LogoutURL(dest string) (string, error) {
+	return "/_ah/login?continue=" + url.QueryEscape(dest) +
+		"&action=Logout", nil
+}
+
+// hasAncestor returns true if the given ancestor is the key or one of
+// its parents.
+func hasAncestor(key, ancestor *datastore.Key) bool {
+	for k := key; k != nil; k = k.Parent() {
+		if k.Equal(ancestor) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// byOrders sorts entities by the given orders and then by their key.
+type byOrders struct {
+	entities []standaloneEntity
+	orders   []string
+}
+
+func (b byOrders) Len() int { return len(b.entities) }
+
+func (b byOrders) Swap(i, j int) {
+	b.entities[i], b.entities[j] = b.entities[j], b.entities[i]
+}
+
+func (b byOrders) Less(i, j int) bool {
+	for _, o := range b.orders {
+		name, desc := strings.TrimPrefix(o, "-"), strings.HasPrefix(o, "-")
+		vi, oki := property(b.entities[i].props, name)
+		vj, okj := property(b.entities[j].props, name)
+
+		// Missing properties sort first.
+		var cmp int
+		switch {
+		case !oki && !okj:
+			cmp = 0
+		case !oki:
+			cmp = -1
+		case !okj:
+			cmp = 1
+		default:
+			cmp, _ = compareValues(vi, vj)
+		}
+
+		if desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp < 0
+		}
+	}
+
+	return b.entities[i].key.String() < b.entities[j].key.String()
+}
+
+// property returns the first value of the named property.
+func property(props []datastore.Property, name string) (interface{}, bool) {
+	for _, p := range props {
+		if p.Name == name {
+			return normalizeValue(p.Value), true
+		}
+	}
+
+	return nil, false
+}
+
+// matchFilters returns true if the properties match all of the
+// filters. Multiple valued properties match if any of their values
+// do.
+func matchFilters(props []datastore.Property, filters []Filter) (bool,
+	error) {
+
+	for _, f := range filters {
+		want := normalizeValue(f.Value)
+		matched := false
+		for _, p := range props {
+			if p.Name != f.Property {
+				continue
+			}
+
+			cmp, ok := compareValues(normalizeValue(p.Value), want)
+			if !ok {
+				continue
+			}
+
+			switch f.Op {
+			case "=":
+				matched = cmp == 0
+			case "<":
+				matched = cmp < 0
+			case "<=":
+				matched = cmp <= 0
+			case ">":
+				matched = cmp > 0
+			case ">=":
+				matched = cmp >= 0
+			default:
+				return false, fmt.Errorf("datastore: invalid operator %q",
+					f.Op)
+			}
+			if matched {
+				break
+			}
+		}
+
+		if !matched {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// normalizeValue converts the integer and float types into int64 and
+// float64 like the datastore does.
+func normalizeValue(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	}
+
+	return v
+}
+
+// compareValues compares two normalized property values. It returns
+// false if they can't be compared.
+func compareValues(a, b interface{}) (int, bool) {
+	switch av := a.(type) {
+	case int64:
+		switch bv := b.(type) {
+		case int64:
+			return compareFloats(float64(av), float64(bv)), true
+		case float64:
+			return compareFloats(float64(av), bv), true
+		}
+	case float64:
+		switch bv := b.(type) {
+		case int64:
+			return compareFloats(av, float64(bv)), true
+		case float64:
+			return compareFloats(av, bv), true
+		}
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv), true
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			switch {
+			case av == bv:
+				return 0, true
+			case !av:
+				return -1, true
+			}
+			return 1, true
+		}
+	case time.Time:
+		if bv, ok := b.(time.Time); ok {
+			switch {
+			case av.Before(bv):
+				return -1, true
+			case av.After(bv):
+				return 1, true
+			}
+			return 0, true
+		}
+	case *datastore.Key:
+		if bv, ok := b.(*datastore.Key); ok {
+			return strings.Compare(av.String(), bv.String()), true
+		}
+	}
+
+	return 0, false
+}
+
+// compareFloats compares two numbers.
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+// encodeStandaloneCursor makes an opaque cursor from the offset.
+func encodeStandaloneCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte("offset:" + strconv.Itoa(offset)))
+}
+
+// decodeStandaloneCursor returns the offset in the cursor.
+func decodeStandaloneCursor(cursor string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	s := string(b)
+	if !strings.HasPrefix(s, "offset:") {
+		return 0, fmt.Errorf("not a cursor: %q", cursor)
+	}
+
+	offset, err := strconv.Atoi(strings.TrimPrefix(s, "offset:"))
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("not a cursor: %q", cursor)
+	}
+
+	return offset, nil
+}
+
+// saveEntity turns the given struct (or pointer to a struct or
+// PropertyLoadSaver) into a list of properties.
+func saveEntity(v reflect.Value) ([]datastore.Property, error) {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Ptr {
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		v = p
+	}
+	if v.IsNil() {
+		return nil, datastore.ErrInvalidEntityType
+	}
+
+	if pls, ok := v.Interface().(datastore.PropertyLoadSaver); ok {
+		return pls.Save()
+	}
+
+	return datastore.SaveStruct(v.Interface())
+}
+
+// loadEntity loads the given properties into the given slice
+// element. Nil pointers are allocated.
+func loadEntity(v reflect.Value, props []datastore.Property) error {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+	} else {
+		v = v.Addr()
+	}
+
+	if pls, ok := v.Interface().(datastore.PropertyLoadSaver); ok {
+		return pls.Load(props)
+	}
+
+	return datastore.LoadStruct(v.Interface(), props)
+}
@@ -0,0 +1,133 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"github.com/icub3d/gorca/internal/testhelper"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"testing"
+)
+
+// standaloneItem is a simple entity used to test the standalone
+// datastore.
+type standaloneItem struct {
+	Name  string
+	Count int64
+}
+
+func TestStandaloneContextDatastore(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+
+	// Put a parent and a child as well as an item of another kind.
+	parent := c.NewKey("Item", "", 1, nil)
+	child := c.NewKey("Item", "child", 0, parent)
+	other := c.NewKey("Other", "", 0, nil)
+	keys, err := c.PutMulti([]*datastore.Key{parent, child, other},
+		[]*standaloneItem{
+			&standaloneItem{"parent", 1},
+			&standaloneItem{"child", 2},
+			&standaloneItem{"other", 3},
+		})
+	h.FatalNotNil("put multi", err)
+	h.FatalNotEqual("incomplete key", keys[2].Incomplete(), false)
+
+	// Get them back.
+	items := make([]standaloneItem, 3)
+	err = c.GetMulti(keys, items)
+	h.FatalNotNil("get multi", err)
+	h.ErrorNotEqual("parent", items[0], standaloneItem{"parent", 1})
+	h.ErrorNotEqual("child", items[1], standaloneItem{"child", 2})
+	h.ErrorNotEqual("other", items[2], standaloneItem{"other", 3})
+
+	// Keys should survive encoding.
+	decoded, err := datastore.DecodeKey(child.Encode())
+	h.FatalNotNil("decoding key", err)
+	h.ErrorNotEqual("decoded key", decoded.Equal(child), true)
+
+	// Query for the ancestors.
+	var found []*standaloneItem
+	q := &Query{Kind: "Item", Ancestor: parent}
+	fkeys, err := c.GetAll(q, &found)
+	h.FatalNotNil("get all", err)
+	h.FatalNotEqual("number of results", len(fkeys), 2)
+	h.ErrorNotEqual("number of values", len(found), 2)
+
+	// Delete the child and make sure it's gone.
+	err = c.DeleteMulti([]*datastore.Key{child})
+	h.FatalNotNil("delete multi", err)
+
+	err = c.GetMulti([]*datastore.Key{parent, child}, items[:2])
+	me, ok := err.(appengine.MultiError)
+	h.FatalNotEqual("multi error", ok, true)
+	h.ErrorNotNil("parent error", me[0])
+	h.ErrorNotEqual("child error", me[1], datastore.ErrNoSuchEntity)
+}
+
+func TestStandaloneContextUsers(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	h.ErrorNotEqual("no user", c.CurrentUser() == nil, true)
+
+	c.Login("test@example.com", true)
+	u := c.CurrentUser()
+	h.FatalNotEqual("logged in", u == nil, false)
+	h.ErrorNotEqual("email", u.Email, "test@example.com")
+	h.ErrorNotEqual("admin", u.Admin, true)
+
+	c.Logout()
+	h.ErrorNotEqual("logged out", c.CurrentUser() == nil, true)
+}
+
+func TestStandaloneContextRollback(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	changed := c.NewKey("Item", "changed", 0, nil)
+	added := c.NewKey("Item", "added", 0, nil)
+	deleted := c.NewKey("Item", "deleted", 0, nil)
+	outside := c.NewKey("Item", "outside", 0, nil)
+	_, err := c.PutMulti([]*datastore.Key{changed, deleted},
+		[]*standaloneItem{{"changed", 1}, {"deleted", 1}})
+	h.FatalNotNil("put multi", err)
+
+	err = c.RunInTransaction(func(tc Context) error {
+		_, err := tc.PutMulti([]*datastore.Key{changed, added},
+			[]*standaloneItem{{"changed", 2}, {"added", 2}})
+		h.FatalNotNil("put in transaction", err)
+		h.FatalNotNil("delete in transaction",
+			tc.DeleteMulti([]*datastore.Key{deleted}))
+		h.FatalNotNil("task in transaction", tc.AddTask("/task", nil, ""))
+
+		// Someone else writes while the transaction runs.
+		_, err = c.PutMulti([]*datastore.Key{outside},
+			[]*standaloneItem{{"outside", 3}})
+		h.FatalNotNil("put outside", err)
+
+		return ErrFailed
+	}, false)
+	h.ErrorNotEqual("transaction error", err, ErrFailed)
+
+	// Only the transaction's changes are undone.
+	items := make([]standaloneItem, 3)
+	err = c.GetMulti([]*datastore.Key{changed, deleted, outside}, items)
+	h.FatalNotNil("get multi", err)
+	h.ErrorNotEqual("items", items, []standaloneItem{{"changed", 1},
+		{"deleted", 1}, {"outside", 3}})
+	err = c.GetMulti([]*datastore.Key{added}, items[:1])
+	h.ErrorNotEqual("added", err,
+		appengine.MultiError{datastore.ErrNoSuchEntity})
+	h.ErrorNotEqual("tasks", len(c.Tasks()), 0)
+
+	// Tasks are queued when it commits.
+	err = c.RunInTransaction(func(tc Context) error {
+		return tc.AddTask("/task", nil, "")
+	}, false)
+	h.FatalNotNil("commit", err)
+	h.ErrorNotEqual("committed tasks", len(c.Tasks()), 1)
+}
@@ -0,0 +1,165 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"encoding/json"
+	"fmt"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"reflect"
+)
+
+// StreamFormat is how StreamQuery writes the results.
+type StreamFormat int
+
+// These are the formats StreamQuery can write.
+const (
+	// StreamJSON writes a JSON array of the results.
+	StreamJSON StreamFormat = iota
+
+	// StreamNDJSON writes each result as JSON on its own line.
+	StreamNDJSON
+)
+
+// StreamFlushInterval is how many results StreamQuery writes between
+// flushes.
+var StreamFlushInterval int = 100
+
+// StreamQuery runs the query and writes each result as an Entity as
+// soon as it is read, so the results are never all in memory. v is an
+// example of the entities (a struct or a pointer to one) and each
+// result is loaded into a new one. If the query is keys only, v may be
+// nil and the values are null. The response is flushed every
+// StreamFlushInterval results. If the query fails before anything is
+// written, the standard error response is sent. After that, failures
+// and clients that disconnect are logged and the response is cut
+// short. It returns true if all of the results were written.
+func StreamQuery(c Context, w http.ResponseWriter, r *http.Request,
+	q *Query, v interface{}, format StreamFormat) bool {
+
+	var t reflect.Type
+	if !q.KeysOnly {
+		if v == nil {
+			LogAndUnexpected(c, w, r, fmt.Errorf("no example entity to "+
+				"stream %s results into", q.Kind))
+			return false
+		}
+
+		t = reflect.TypeOf(v)
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+	}
+
+	it, err := c.Run(q)
+	if err != nil {
+		LogAndError(c, w, r, DatastoreError(err))
+		return false
+	}
+
+	// next reads the next result.
+	next := func() (*Entity, error) {
+		var dst interface{}
+		if !q.KeysOnly {
+			dst = reflect.New(t).Interface()
+		}
+
+		key, err := it.Next(dst)
+		if err != nil {
+			return nil, err
+		}
+		return &Entity{Key: key.Encode(), Value: dst}, nil
+	}
+
+	// Get the first result so we can still send an error if the
+	// query fails.
+	e, err := next()
+	if err != nil && err != datastore.Done {
+		LogAndError(c, w, r, DatastoreError(err))
+		return false
+	}
+
+	if format == StreamNDJSON {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	sw := &streamWriter{c: c, w: w, r: r}
+	if format == StreamJSON {
+		sw.write([]byte("["))
+	}
+
+	for ; err == nil; e, err = next() {
+		b, merr := json.Marshal(e)
+		if merr != nil {
+			Log(c, r, "error", "stream cut short after %d results: %v",
+				sw.count, merr)
+			return false
+		}
+
+		switch {
+		case format == StreamNDJSON:
+			b = append(b, '\n')
+		case sw.count > 0:
+			b = append([]byte(","), b...)
+		}
+		if !sw.write(b) {
+			return false
+		}
+
+		sw.count++
+		if StreamFlushInterval > 0 && sw.count%StreamFlushInterval == 0 {
+			sw.flush()
+		}
+	}
+	if err != datastore.Done {
+		Log(c, r, "error", "stream cut short after %d results: %v",
+			sw.count, err)
+		return false
+	}
+
+	if format == StreamJSON && !sw.write([]byte("]")) {
+		return false
+	}
+	sw.flush()
+
+	return true
+}
+
+// streamWriter writes the parts of a streamed response.
+type streamWriter struct {
+	c     Context
+	w     http.ResponseWriter
+	r     *http.Request
+	count int
+}
+
+// write writes the bytes. If the client is gone, it is logged and
+// false is returned.
+func (sw *streamWriter) write(b []byte) bool {
+	if err := sw.r.Context().Err(); err != nil {
+		Log(sw.c, sw.r, "warn", "client disconnected after %d results: %v",
+			sw.count, err)
+		return false
+	}
+
+	if _, err := sw.w.Write(b); err != nil {
+		Log(sw.c, sw.r, "warn", "client disconnected after %d results: %v",
+			sw.count, err)
+		return false
+	}
+
+	return true
+}
+
+// flush sends what has been written so far to the client.
+func (sw *streamWriter) flush() {
+	if f, ok := sw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
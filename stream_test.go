@@ -0,0 +1,169 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/icub3d/gorca/internal/testhelper"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStreamQuery(t *testing.T) {
+	h := testhelper.New(t)
+
+	defer func(interval int) { StreamFlushInterval = interval }(
+		StreamFlushInterval)
+	StreamFlushInterval = 2
+
+	c := NewStandaloneContext()
+	h.FatalNotNil("put items", putPageItems(c, 5))
+
+	tests := []struct {
+		q        *Query
+		noValue  bool
+		format   StreamFormat
+		canceled bool
+		result   bool
+		ecode    int
+		ectype   string
+		ecounts  []int64
+		ebody    string
+	}{
+		// A JSON array.
+		{
+			q:       &Query{Kind: "Item", Orders: []string{"Count"}},
+			format:  StreamJSON,
+			result:  true,
+			ecode:   http.StatusOK,
+			ectype:  "application/json; charset=utf-8",
+			ecounts: []int64{0, 1, 2, 3, 4},
+		},
+
+		// NDJSON.
+		{
+			q:       &Query{Kind: "Item", Orders: []string{"-Count"}, Limit: 3},
+			format:  StreamNDJSON,
+			result:  true,
+			ecode:   http.StatusOK,
+			ectype:  "application/x-ndjson",
+			ecounts: []int64{4, 3, 2},
+		},
+
+		// Nothing found.
+		{
+			q:      &Query{Kind: "Other"},
+			format: StreamJSON,
+			result: true,
+			ecode:  http.StatusOK,
+			ectype: "application/json; charset=utf-8",
+			ebody:  "[]",
+		},
+
+		// A bad cursor.
+		{
+			q:      &Query{Kind: "Item", Cursor: "bad"},
+			format: StreamJSON,
+			ecode:  http.StatusBadRequest,
+			ectype: "text/json; charset=utf-8",
+			ebody:  `{"Type":"error","Message":"Invalid cursor."}`,
+		},
+
+		// Keys only, without an example entity.
+		{
+			q:       &Query{Kind: "Item", KeysOnly: true, Limit: 2},
+			noValue: true,
+			format:  StreamNDJSON,
+			result:  true,
+			ecode:   http.StatusOK,
+			ectype:  "application/x-ndjson",
+			ecounts: []int64{0, 0},
+		},
+
+		// No example entity for the values.
+		{
+			q:       &Query{Kind: "Item"},
+			noValue: true,
+			format:  StreamJSON,
+			ecode:   http.StatusInternalServerError,
+			ectype:  "text/json; charset=utf-8",
+			ebody: `{"Type":"error","Message":"Something unexpected ` +
+				`happened."}`,
+		},
+
+		// The client went away.
+		{
+			q:        &Query{Kind: "Item"},
+			format:   StreamNDJSON,
+			canceled: true,
+			ecode:    http.StatusOK,
+			ectype:   "application/x-ndjson",
+		},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		r, err := http.NewRequest("GET", "/export", nil)
+		h.FatalNotNil("creating request", err)
+		if test.canceled {
+			ctx, cancel := context.WithCancel(r.Context())
+			cancel()
+			r = r.WithContext(ctx)
+		}
+		w := httptest.NewRecorder()
+
+		var v interface{} = pageItem{}
+		if test.noValue {
+			v = nil
+		}
+
+		result := StreamQuery(c, w, r, test.q, v, test.format)
+		h.ErrorNotEqual("result", result, test.result)
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		h.ErrorNotEqual("content type", w.Header().Get("Content-Type"),
+			test.ectype)
+
+		if test.ecounts == nil {
+			h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+			continue
+		}
+		h.ErrorNotEqual("flushed", w.Flushed, true)
+		if test.q.KeysOnly {
+			h.ErrorNotEqual("null values", strings.Count(w.Body.String(),
+				`"Value":null`), len(test.ecounts))
+		}
+
+		// Read back the entities.
+		var entities []struct {
+			Key   string
+			Value pageItem
+		}
+		if test.format == StreamJSON {
+			err = json.Unmarshal(w.Body.Bytes(), &entities)
+			h.FatalNotNil("unmarshal", err)
+		} else {
+			lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"),
+				"\n")
+			for _, line := range lines {
+				entities = append(entities, struct {
+					Key   string
+					Value pageItem
+				}{})
+				err = json.Unmarshal([]byte(line), &entities[len(entities)-1])
+				h.FatalNotNil("unmarshal", err)
+			}
+		}
+
+		var counts []int64
+		for _, e := range entities {
+			counts = append(counts, e.Value.Count)
+		}
+		h.ErrorNotEqual("counts", counts, test.ecounts)
+	}
+}
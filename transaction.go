@@ -0,0 +1,87 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"errors"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"time"
+)
+
+// These are the defaults for the TransactionOptions.
+const (
+	DefaultTransactionAttempts = 3
+	DefaultTransactionBackoff  = 100 * time.Millisecond
+)
+
+// TransactionOptions are the options for RunInTransactionOrFail.
+type TransactionOptions struct {
+	// XG allows the transaction to use entities from more than one
+	// entity group.
+	XG bool
+
+	// Attempts is the most times the transaction is tried. If it is
+	// zero, DefaultTransactionAttempts is used.
+	Attempts int
+
+	// Backoff is how long to wait before the first retry. The wait
+	// doubles after each retry. If it is zero,
+	// DefaultTransactionBackoff is used.
+	Backoff time.Duration
+}
+
+// RunInTransactionOrFail is a helper function that runs fn in a
+// transaction. fn should only use the datastore through the given
+// Context and may be called more than once. If the transaction
+// collides with another one, it is retried with backoff. If a failure
+// occured, false is returned and a response was returned to the
+// request. fn may return a registered error (see RegisterError) to
+// choose the response; other errors are classified with
+// DatastoreError, so an ErrBusy is sent if the retries run out. This
+// case should be terminal. opts may be nil to use the defaults.
+func RunInTransactionOrFail(c Context, w http.ResponseWriter,
+	r *http.Request, fn func(tc Context) error,
+	opts *TransactionOptions) bool {
+
+	if opts == nil {
+		opts = &TransactionOptions{}
+	}
+	attempts := opts.Attempts
+	if attempts <= 0 {
+		attempts = DefaultTransactionAttempts
+	}
+	backoff := opts.Backoff
+	if backoff <= 0 {
+		backoff = DefaultTransactionBackoff
+	}
+
+	err := c.RunInTransaction(fn, opts.XG)
+	for attempt := 1; attempt < attempts &&
+		errors.Is(err, datastore.ErrConcurrentTransaction); attempt++ {
+
+		Log(c, r, "warn", "transaction collided (attempt %d of %d), "+
+			"retrying in %v", attempt, attempts, backoff)
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-c.Done():
+			t.Stop()
+			LogAndError(c, w, r, DatastoreError(c.Err()))
+			return false
+		}
+		backoff *= 2
+
+		err = c.RunInTransaction(fn, opts.XG)
+	}
+
+	if err != nil {
+		LogAndError(c, w, r, DatastoreError(err))
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,145 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"context"
+	"fmt"
+	"github.com/icub3d/gorca/internal/testhelper"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRunInTransactionOrFail(t *testing.T) {
+	h := testhelper.New(t)
+
+	tests := []struct {
+		// collisions is how many times the transaction collides
+		// before fn returns err.
+		collisions int
+		err        error
+		nested     bool
+		canceled   bool
+		ecalls     int
+		eresult    bool
+		esaved     bool
+		ecode      int
+		ebody      string
+		eretry     string
+	}{
+		// Normal operation.
+		{
+			ecalls:  1,
+			eresult: true,
+			esaved:  true,
+			ecode:   http.StatusOK,
+		},
+
+		// Collisions that eventually succeed.
+		{
+			collisions: 2,
+			ecalls:     3,
+			eresult:    true,
+			esaved:     true,
+			ecode:      http.StatusOK,
+		},
+
+		// Collisions until we run out of attempts.
+		{
+			collisions: 5,
+			ecalls:     3,
+			ecode:      http.StatusServiceUnavailable,
+			ebody:      `{"Type":"error","Message":"Busy. Please try again."}`,
+			eretry:     "1",
+		},
+
+		// A registered error is sent and the put is rolled back.
+		{
+			err:    ErrNotFound.Wrap(fmt.Errorf("missing")),
+			ecalls: 1,
+			ecode:  http.StatusNotFound,
+			ebody:  `{"Type":"error","Message":"Not found."}`,
+		},
+
+		// Any other error is unexpected.
+		{
+			err:    fmt.Errorf("oops"),
+			ecalls: 1,
+			ecode:  http.StatusInternalServerError,
+			ebody:  `{"Type":"error","Message":"Something unexpected happened."}`,
+		},
+
+		// Nested transactions aren't allowed.
+		{
+			nested: true,
+			ecalls: 1,
+			ecode:  http.StatusInternalServerError,
+			ebody:  `{"Type":"error","Message":"Something unexpected happened."}`,
+		},
+
+		// Canceled while waiting to retry.
+		{
+			collisions: 5,
+			canceled:   true,
+			ecalls:     1,
+			ecode:      http.StatusInternalServerError,
+			ebody:      `{"Type":"error","Message":"Something unexpected happened."}`,
+		},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		sc := NewStandaloneContext()
+		ctx, cancel := context.WithCancel(context.Background())
+		c := sc.WithContext(ctx)
+		key := c.NewKey("Item", "tx", 0, nil)
+
+		calls := 0
+		fn := func(tc Context) error {
+			calls++
+			_, err := tc.PutMulti([]*datastore.Key{key},
+				[]*standaloneItem{&standaloneItem{"tx", int64(calls)}})
+			if err != nil {
+				return err
+			}
+
+			if test.nested {
+				return tc.RunInTransaction(func(Context) error {
+					return nil
+				}, false)
+			}
+			if calls <= test.collisions {
+				if test.canceled {
+					cancel()
+				}
+				return datastore.ErrConcurrentTransaction
+			}
+			return test.err
+		}
+
+		r, err := http.NewRequest("POST", "/tx", nil)
+		h.FatalNotNil("creating request", err)
+		w := httptest.NewRecorder()
+
+		result := RunInTransactionOrFail(c, w, r, fn,
+			&TransactionOptions{Backoff: time.Millisecond})
+		cancel()
+
+		h.ErrorNotEqual("result", result, test.eresult)
+		h.ErrorNotEqual("calls", calls, test.ecalls)
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+		h.ErrorNotEqual("retry after", w.Header().Get("Retry-After"),
+			test.eretry)
+
+		items := make([]standaloneItem, 1)
+		err = sc.GetMulti([]*datastore.Key{key}, items)
+		h.ErrorNotEqual("saved", err == nil, test.esaved)
+	}
+}
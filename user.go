@@ -5,21 +5,22 @@
 package gorca
 
 import (
-	"appengine"
-	"appengine/user"
 	"fmt"
+	"google.golang.org/appengine/user"
 	"net/http"
+	"strings"
 )
 
 // GetUserOrUnexpected fetches the currently logged in user and
 // returns it. The bool returns determines if the get was
 // successful. If not, a JSON "unexpected" message is sent as the
-// response. That case should terminate your response processing.
-func GetUserOrUnexpected(c appengine.Context, w http.ResponseWriter,
+// response. That case should terminate your response processing. To
+// send a 401 instead, use RequireRolesOrFail or GetUserOrLogin.
+func GetUserOrUnexpected(c Context, w http.ResponseWriter,
 	r *http.Request) (*user.User, bool) {
 
 	// Get the current user.
-	u := user.Current(c)
+	u := c.CurrentUser()
 	if u == nil {
 		LogAndUnexpected(c, w, r,
 			fmt.Errorf("no user found, but auth is required."))
@@ -34,11 +35,11 @@ func GetUserOrUnexpected(c appengine.Context, w http.ResponseWriter,
 // and returns it. The bool returns determines if the get was
 // successful. If not, a JSON "unexpected" message is sent as the
 // response. That case should terminate your response processing.
-func GetUserLogoutURL(c appengine.Context, w http.ResponseWriter,
+func GetUserLogoutURL(c Context, w http.ResponseWriter,
 	r *http.Request, dest string) (string, bool) {
 
 	// Get their logout URL.
-	logout, err := user.LogoutURL(c, dest)
+	logout, err := c.LogoutURL(dest)
 	if err != nil {
 		LogAndUnexpected(c, w, r, fmt.Errorf("calling LogoutURL: %s", err))
 		return "", false
@@ -46,3 +47,100 @@ func GetUserLogoutURL(c appengine.Context, w http.ResponseWriter,
 
 	return logout, true
 }
+
+// GetUserLoginURL fetches a URL that has the user log in and then
+// redirects them to dest. The bool returns determines if the get was
+// successful. If not, a JSON "unexpected" message is sent as the
+// response. That case should terminate your response processing.
+func GetUserLoginURL(c Context, w http.ResponseWriter,
+	r *http.Request, dest string) (string, bool) {
+
+	// Get their login URL.
+	login, err := c.LoginURL(dest)
+	if err != nil {
+		LogAndUnexpected(c, w, r, fmt.Errorf("calling LoginURL: %s", err))
+		return "", false
+	}
+
+	return login, true
+}
+
+// GetUserOrLogin fetches the request's principal (see AuthHandler)
+// or the currently logged in user and returns it. The bool returns
+// determines if there was one. If not, browsers navigating to a page
+// are redirected to the login URL, which brings them back to the
+// page, and everything else (XHR and API clients) is sent a 401
+// "unauthenticated" message. That case should terminate your
+// response processing.
+func GetUserOrLogin(c Context, w http.ResponseWriter,
+	r *http.Request) (*user.User, bool) {
+
+	if p := currentPrincipal(c, r); p != nil {
+		return p.User(), true
+	}
+
+	if !isNavigation(r) {
+		LogAndError(c, w, r, ErrUnauthenticated.Wrap(
+			fmt.Errorf("no user found, but login is required")))
+		return nil, false
+	}
+
+	login, ok := GetUserLoginURL(c, w, r, r.URL.RequestURI())
+	if !ok {
+		return nil, false
+	}
+
+	Log(c, r, "info", "redirecting to login: %s", login)
+	http.Redirect(w, r, login, http.StatusFound)
+	return nil, false
+}
+
+// isNavigation returns true if the request looks like a browser
+// navigating to a page: a GET or HEAD that isn't an XHR and prefers
+// HTML to JSON.
+func isNavigation(r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if strings.EqualFold(r.Header.Get("X-Requested-With"),
+		"XMLHttpRequest") {
+
+		return false
+	}
+
+	// Browsers that send it tell us outright.
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+
+	ranges := parseAccept(r.Header.Get("Accept"))
+	return acceptQuality(ranges, "text/html") >
+		acceptQuality(ranges, "application/json")
+}
+
+// LoginHandler is middleware that only lets logged in users through
+// to Handler. Everyone else gets the responses sent by
+// GetUserOrLogin.
+type LoginHandler struct {
+	Handler http.Handler
+
+	// NewContext makes the Context for a request. If it is nil, the
+	// package NewContext is used.
+	NewContext func(r *http.Request) Context
+}
+
+// RequireLogin returns a LoginHandler for the handler.
+func RequireLogin(h http.Handler) *LoginHandler {
+	return &LoginHandler{Handler: h}
+}
+
+// ServeHTTP implements http.Handler.
+func (lh *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := contextFor(lh.NewContext, r)
+
+	if _, ok := GetUserOrLogin(c, w, r); !ok {
+		return
+	}
+
+	lh.Handler.ServeHTTP(w, r)
+}
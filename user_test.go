@@ -5,11 +5,9 @@
 package gorca
 
 import (
-	"github.com/icub3d/appenginetesting"
-	"github.com/icub3d/testhelper"
+	"github.com/icub3d/gorca/internal/testhelper"
 	"net/http"
 	"net/http/httptest"
-	"strings"
 	"testing"
 )
 
@@ -17,9 +15,7 @@ func TestGetUserOrUnexpected(t *testing.T) {
 	h := testhelper.New(t)
 
 	// We are going to reuse the context here.
-	c, err := appenginetesting.NewContext(nil)
-	h.FatalNotNil("creating context", err)
-	defer c.Close()
+	c := NewStandaloneContext()
 
 	tests := []struct {
 		f       func()
@@ -97,9 +93,7 @@ func TestGetUserOrUnexpected(t *testing.T) {
 func TestGetUserLogoutURL(t *testing.T) {
 	h := testhelper.New(t)
 
-	c, err := appenginetesting.NewContext(nil)
-	h.FatalNotNil("creating context", err)
-	defer c.Close()
+	c := NewStandaloneContext()
 
 	// Make the request and writer.
 	w := httptest.NewRecorder()
@@ -109,10 +103,138 @@ func TestGetUserLogoutURL(t *testing.T) {
 	url, ok := GetUserLogoutURL(c, w, r, "/")
 	h.FatalNotEqual("getting url", ok, true)
 
-	surl := "/_ah/login?continue=http%3A//127.0.0.1%3A"
-	eurl := "/&action=Logout"
-	if !strings.HasPrefix(url, surl) || !strings.HasSuffix(url, eurl) {
-		t.Errorf("Expecting '%v' for url, but got: %v",
-			surl+"[PORT]"+eurl, url)
+	h.ErrorNotEqual("url", url, "/_ah/login?continue=%2F&action=Logout")
+}
+
+func TestGetUserLoginURL(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+
+	// Make the request and writer.
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/", nil)
+	h.FatalNotNil("creating request", err)
+
+	url, ok := GetUserLoginURL(c, w, r, "/")
+	h.FatalNotEqual("getting url", ok, true)
+
+	h.ErrorNotEqual("url", url, "/_ah/login?continue=%2F")
+}
+
+func TestRequireLogin(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+
+	tests := []struct {
+		email     string
+		method    string
+		headers   map[string]string
+		ecode     int
+		elocation string
+		ebody     string
+	}{
+		// Logged in.
+		{
+			email:  "test@example.com",
+			method: "GET",
+			ecode:  http.StatusOK,
+		},
+
+		// A browser navigating to the page.
+		{
+			method: "GET",
+			headers: map[string]string{
+				"Accept": "text/html,application/xhtml+xml,*/*;q=0.8",
+			},
+			ecode:     http.StatusFound,
+			elocation: "/_ah/login?continue=%2Fpage%3Fa%3Db",
+		},
+		{
+			method: "GET",
+			headers: map[string]string{
+				"Accept":         "*/*",
+				"Sec-Fetch-Mode": "navigate",
+			},
+			ecode:     http.StatusFound,
+			elocation: "/_ah/login?continue=%2Fpage%3Fa%3Db",
+		},
+
+		// An XHR.
+		{
+			method: "GET",
+			headers: map[string]string{
+				"Accept":           "text/html",
+				"X-Requested-With": "XMLHttpRequest",
+			},
+			ecode: http.StatusUnauthorized,
+			ebody: `{"Type":"error","Message":"You must be logged in to do that."}`,
+		},
+		{
+			method: "GET",
+			headers: map[string]string{
+				"Accept":         "text/html",
+				"Sec-Fetch-Mode": "cors",
+			},
+			ecode: http.StatusUnauthorized,
+			ebody: `{"Type":"error","Message":"You must be logged in to do that."}`,
+		},
+
+		// An API client.
+		{
+			method: "GET",
+			headers: map[string]string{
+				"Accept": "application/json",
+			},
+			ecode: http.StatusUnauthorized,
+			ebody: `{"Type":"error","Message":"You must be logged in to do that."}`,
+		},
+		{
+			method: "GET",
+			ecode:  http.StatusUnauthorized,
+			ebody:  `{"Type":"error","Message":"You must be logged in to do that."}`,
+		},
+
+		// A form post isn't redirected.
+		{
+			method: "POST",
+			headers: map[string]string{
+				"Accept": "text/html",
+			},
+			ecode: http.StatusUnauthorized,
+			ebody: `{"Type":"error","Message":"You must be logged in to do that."}`,
+		},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		c.Logout()
+		if test.email != "" {
+			c.Login(test.email, false)
+		}
+
+		handler := RequireLogin(http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+
+			WriteSuccessMessage(c, w, r)
+		}))
+		handler.NewContext = func(r *http.Request) Context { return c }
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest(test.method, "/page?a=b", nil)
+		h.FatalNotNil("creating request", err)
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		handler.ServeHTTP(w, r)
+
+		h.ErrorNotEqual("response code", w.Code, test.ecode)
+		h.ErrorNotEqual("location", w.Header().Get("Location"),
+			test.elocation)
+		if test.ebody != "" {
+			h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+		}
 	}
 }
@@ -0,0 +1,374 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// FieldError describes why a single field is invalid. Field is the
+// path to the field using the JSON names (e.g. "items[2].name").
+type FieldError struct {
+	Field  string
+	Reason string
+}
+
+// ValidationError lists every invalid field found by Validate.
+type ValidationError []FieldError
+
+// Error implements the error interface.
+func (v ValidationError) Error() string {
+	reasons := make([]string, 0, len(v))
+	for _, f := range v {
+		reasons = append(reasons, f.Field+" "+f.Reason)
+	}
+
+	return "invalid: " + strings.Join(reasons, "; ")
+}
+
+// Validate checks the struct (or pointer to a struct) v against the
+// validate tags of its fields, including those of nested structs,
+// slices and maps. The tag is a comma separated list of rules:
+//
+//	required     the field must not be the zero value.
+//	min=N        the number must be at least N.
+//	max=N        the number must be at most N.
+//	len=N        the string, slice or map must have a length of N.
+//	minlen=N     the length must be at least N.
+//	maxlen=N     the length must be at most N.
+//	enum=a|b|c   the value must be one of the given values.
+//	regexp=RE    the string must match RE. This must be the last
+//	             rule, as RE may contain commas.
+//	omitempty    the other rules are skipped for the zero value.
+//
+// Nil pointers are only checked by required. Other fields are checked
+// by all of their rules, even when they are the zero value, unless
+// they are omitempty. If any fields are invalid, a ValidationError
+// listing all of them is returned. Any other error means a tag is
+// malformed.
+func Validate(v interface{}) error {
+	vd := &validator{}
+	vd.validateValue("", reflect.ValueOf(v))
+	if vd.err != nil {
+		return vd.err
+	}
+	if len(vd.errs) > 0 {
+		return vd.errs
+	}
+
+	return nil
+}
+
+// ValidateOrFail validates v. If it is invalid, a 422 listing the
+// invalid fields is sent as the response (see ErrInvalid) and false is
+// returned. In that case, this should be terminal.
+func ValidateOrFail(c Context, w http.ResponseWriter, r *http.Request,
+	v interface{}) bool {
+
+	err := Validate(v)
+	if _, ok := err.(ValidationError); ok {
+		LogAndError(c, w, r, ErrInvalid.Wrap(err))
+		return false
+	} else if err != nil {
+		LogAndUnexpected(c, w, r, err)
+		return false
+	}
+
+	return true
+}
+
+// validator collects the errors found while walking a value.
+type validator struct {
+	errs ValidationError
+	err  error
+}
+
+// timeType is not walked into as it has no exported fields.
+var timeType = reflect.TypeOf(time.Time{})
+
+// validateValue walks into v looking for tagged struct fields.
+func (vd *validator) validateValue(path string, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			vd.validateValue(path, v.Elem())
+		}
+
+	case reflect.Struct:
+		if v.Type() != timeType {
+			vd.validateStruct(path, v)
+		}
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			vd.validateValue(fmt.Sprintf("%s[%d]", path, i), v.Index(i))
+		}
+
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) <
+				fmt.Sprint(keys[j].Interface())
+		})
+		for _, k := range keys {
+			vd.validateValue(joinPath(path, fmt.Sprint(k.Interface())),
+				v.MapIndex(k))
+		}
+	}
+}
+
+// validateStruct checks each of the exported fields of the struct.
+func (vd *validator) validateStruct(path string, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name, named := jsonName(f)
+		if name == "-" {
+			continue
+		}
+
+		// Embedded structs are flattened by encoding/json.
+		p := path
+		if !f.Anonymous || named {
+			p = joinPath(path, name)
+		}
+
+		if tag := f.Tag.Get("validate"); tag != "" && tag != "-" {
+			vd.validateField(p, v.Field(i), tag)
+		}
+		vd.validateValue(p, v.Field(i))
+	}
+}
+
+// validateField checks the value against the rules in the tag.
+func (vd *validator) validateField(path string, v reflect.Value,
+	tag string) {
+
+	rules := parseRules(tag)
+
+	if isZero(v) {
+		_, required := rules["required"]
+		_, omitempty := rules["omitempty"]
+		if required {
+			vd.add(path, "is required")
+			return
+		}
+
+		nilable := v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface
+		if omitempty || nilable {
+			return
+		}
+	}
+
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+
+	// Check them in a stable order.
+	names := make([]string, 0, len(rules))
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		arg := rules[name]
+
+		switch name {
+		case "required", "omitempty":
+
+		case "min", "max":
+			n, ok := number(v)
+			limit, err := strconv.ParseFloat(arg, 64)
+			if !ok || err != nil {
+				vd.badTag(path, tag)
+				return
+			}
+			if name == "min" && n < limit {
+				vd.add(path, "must be at least "+arg)
+			} else if name == "max" && n > limit {
+				vd.add(path, "must be at most "+arg)
+			}
+
+		case "len", "minlen", "maxlen":
+			l, ok := length(v)
+			limit, err := strconv.Atoi(arg)
+			if !ok || err != nil {
+				vd.badTag(path, tag)
+				return
+			}
+			if name == "len" && l != limit {
+				vd.add(path, "must have a length of "+arg)
+			} else if name == "minlen" && l < limit {
+				vd.add(path, "must have a length of at least "+arg)
+			} else if name == "maxlen" && l > limit {
+				vd.add(path, "must have a length of at most "+arg)
+			}
+
+		case "enum":
+			options := strings.Split(arg, "|")
+			s := fmt.Sprint(v.Interface())
+			found := false
+			for _, o := range options {
+				if o == s {
+					found = true
+					break
+				}
+			}
+			if !found {
+				vd.add(path, "must be one of "+strings.Join(options, ", "))
+			}
+
+		case "regexp":
+			re, err := compileRegexp(arg)
+			if err != nil || v.Kind() != reflect.String {
+				vd.badTag(path, tag)
+				return
+			}
+			if !re.MatchString(v.String()) {
+				vd.add(path, "must match "+arg)
+			}
+
+		default:
+			vd.badTag(path, tag)
+			return
+		}
+	}
+}
+
+// add records an invalid field.
+func (vd *validator) add(path, reason string) {
+	vd.errs = append(vd.errs, FieldError{Field: path, Reason: reason})
+}
+
+// badTag records a malformed tag. Only the first one is kept.
+func (vd *validator) badTag(path, tag string) {
+	if vd.err == nil {
+		vd.err = fmt.Errorf("bad validate tag on %s: %q", path, tag)
+	}
+}
+
+// parseRules splits the tag into its rules and their arguments.
+func parseRules(tag string) map[string]string {
+	rules := make(map[string]string)
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(tag, "regexp=") {
+			rule, tag = tag, ""
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			rule, tag = tag[:i], tag[i+1:]
+		} else {
+			rule, tag = tag, ""
+		}
+
+		name, arg := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			name, arg = rule[:i], rule[i+1:]
+		}
+		rules[strings.TrimSpace(name)] = arg
+	}
+
+	return rules
+}
+
+// regexps caches the compiled regexp rules.
+var regexps = struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}{m: make(map[string]*regexp.Regexp)}
+
+// compileRegexp returns the compiled regexp for the given rule.
+func compileRegexp(s string) (*regexp.Regexp, error) {
+	regexps.Lock()
+	defer regexps.Unlock()
+
+	if re, ok := regexps.m[s]; ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, err
+	}
+	regexps.m[s] = re
+
+	return re, nil
+}
+
+// jsonName returns the name encoding/json uses for the field and
+// whether it came from the tag.
+func jsonName(f reflect.StructField) (string, bool) {
+	tag := f.Tag.Get("json")
+	if i := strings.Index(tag, ","); i >= 0 {
+		tag = tag[:i]
+	}
+	if tag != "" {
+		return tag, true
+	}
+
+	return f.Name, false
+}
+
+// joinPath adds the name to the path.
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+
+	return path + "." + name
+}
+
+// isZero returns true if v is the zero value for its type. Empty
+// slices and maps are also considered zero.
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+
+	return v.IsZero()
+}
+
+// number returns the value of v as a float64 if it is a number.
+func number(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+
+	return 0, false
+}
+
+// length returns the length of v if it has one. Strings are measured
+// in runes.
+func length(v reflect.Value) (int, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return utf8.RuneCountInString(v.String()), true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return v.Len(), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,149 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"github.com/icub3d/gorca/internal/testhelper"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// validateItem is a nested struct used to test Validate.
+type validateItem struct {
+	Name  string `json:"name" validate:"required,maxlen=5"`
+	Count int    `json:"count" validate:"min=1,max=10"`
+}
+
+// validateList is the top level struct used to test Validate.
+type validateList struct {
+	Title  string         `json:"title" validate:"required"`
+	Color  string         `json:"color" validate:"omitempty,enum=red|green|blue"`
+	Code   string         `json:"code" validate:"omitempty,len=3,regexp=^[A-Z]{3}$"`
+	Tags   []string       `json:"tags" validate:"omitempty,minlen=1"`
+	Owner  *validateItem  `json:"owner"`
+	Items  []validateItem `json:"items" validate:"maxlen=2"`
+	Ignore string         `json:"-" validate:"required"`
+	hidden string         `validate:"required"`
+}
+
+func TestValidate(t *testing.T) {
+	h := testhelper.New(t)
+
+	tests := []struct {
+		v        interface{}
+		expected ValidationError
+		bad      bool
+	}{
+		// A valid list.
+		{
+			v: &validateList{
+				Title: "groceries",
+				Color: "red",
+				Code:  "ABC",
+				Tags:  []string{"food"},
+				Owner: &validateItem{Name: "bob", Count: 1},
+				Items: []validateItem{{Name: "milk", Count: 2}},
+			},
+			expected: nil,
+		},
+
+		// Optional fields that aren't set.
+		{
+			v:        validateList{Title: "groceries"},
+			expected: nil,
+		},
+
+		// Everything is wrong.
+		{
+			v: &validateList{
+				Color: "purple",
+				Code:  "abcd",
+				Owner: &validateItem{Count: 11},
+				Items: []validateItem{
+					{Name: "milk", Count: 2},
+					{Name: "cheese", Count: -1},
+					{Name: "eggs", Count: 12},
+				},
+			},
+			expected: ValidationError{
+				{"title", "is required"},
+				{"color", "must be one of red, green, blue"},
+				{"code", "must have a length of 3"},
+				{"code", "must match ^[A-Z]{3}$"},
+				{"owner.name", "is required"},
+				{"owner.count", "must be at most 10"},
+				{"items", "must have a length of at most 2"},
+				{"items[1].name", "must have a length of at most 5"},
+				{"items[1].count", "must be at least 1"},
+				{"items[2].count", "must be at most 10"},
+			},
+		},
+
+		// Zero values are checked unless they are omitempty.
+		{
+			v: &struct {
+				Count  int    `validate:"min=1"`
+				Color  string `validate:"enum=red|green"`
+				Option int    `validate:"omitempty,min=1"`
+			}{},
+			expected: ValidationError{
+				{"Count", "must be at least 1"},
+				{"Color", "must be one of red, green"},
+			},
+		},
+
+		// A malformed tag.
+		{
+			v: &struct {
+				Name string `validate:"min=1"`
+			}{Name: "bob"},
+			bad: true,
+		},
+	}
+
+	for i, test := range tests {
+		h.SetIndex(i)
+		h.SetFunc("Validate(%v)", test.v)
+
+		err := Validate(test.v)
+		if test.bad {
+			_, ok := err.(ValidationError)
+			h.ErrorNil("bad tag error", err)
+			h.ErrorNotEqual("validation error", ok, false)
+			continue
+		}
+
+		if test.expected == nil {
+			h.ErrorNotNil("valid", err)
+			continue
+		}
+
+		h.ErrorNotEqual("errors", err, test.expected)
+	}
+}
+
+func TestValidateOrFail(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+
+	// Make the request and writer.
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("POST", "/items",
+		strings.NewReader(`{"name":"cheese","count":0}`))
+	h.FatalNotNil("creating request", err)
+
+	var item validateItem
+	ok := UnmarshalFromBodyOrFail(c, w, r, &item)
+	h.FatalNotEqual("unmarshal", ok, false)
+
+	h.ErrorNotEqual("response code", w.Code, http.StatusUnprocessableEntity)
+	h.ErrorNotEqual("response body", w.Body.String(),
+		`{"Type":"error","Message":"Invalid.","Fields":[`+
+			`{"Field":"name","Reason":"must have a length of at most 5"},`+
+			`{"Field":"count","Reason":"must be at least 1"}]}`)
+}
@@ -0,0 +1,157 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"fmt"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"reflect"
+)
+
+// ErrConflict is sent when a versioned put is based on an old
+// version of the entity.
+var ErrConflict = RegisterError(&Error{
+	Code:     "conflict",
+	Status:   http.StatusConflict,
+	Message:  "The entity was changed by someone else.",
+	Severity: "info",
+})
+
+// VersionConflict is the cause of an ErrConflict. Current is the
+// version of the stored entity, which is sent with the error.
+type VersionConflict struct {
+	Key     *datastore.Key
+	Current int64
+}
+
+// Error implements error.
+func (vc *VersionConflict) Error() string {
+	return fmt.Sprintf("%v is at version %d", vc.Key, vc.Current)
+}
+
+// PutVersionedKeys is a helper function that performs a PutMulti on
+// the set of keys and values like PutKeys, but only if none of the
+// entities have changed since they were read. The values must be
+// structs (or pointers to them) with an integer field tagged
+// `gorca:"version"`. In a transaction, each value's version is
+// compared with the stored entity's (a missing entity is version
+// zero). If they all match, the versions are incremented in values
+// and saved. Otherwise, nothing is saved and a 409 with the current
+// version is sent. Entities from more than one entity group use a
+// cross-group transaction, so there can be at most 25 groups. If a
+// failure occured, false is returned and a response was returned to
+// the request. This case should be terminal.
+func PutVersionedKeys(c Context, w http.ResponseWriter, r *http.Request,
+	keys []*datastore.Key, values interface{}) bool {
+
+	vv := reflect.ValueOf(values)
+	if vv.Kind() != reflect.Slice || vv.Len() != len(keys) {
+		LogAndUnexpected(c, w, r, fmt.Errorf("putting %d keys: values "+
+			"must be a slice of the same length", len(keys)))
+		return false
+	}
+
+	// Find the versions the client has.
+	fields := make([]reflect.Value, len(keys))
+	versions := make([]int64, len(keys))
+	for x := range keys {
+		f, err := versionField(vv.Index(x))
+		if err != nil {
+			LogAndUnexpected(c, w, r, err)
+			return false
+		}
+		fields[x], versions[x] = f, f.Int()
+	}
+
+	// The stored entities are loaded into new values of the same
+	// type.
+	et := vv.Type().Elem()
+	if et.Kind() == reflect.Ptr {
+		et = et.Elem()
+	}
+
+	fn := func(tc Context) error {
+		stored := reflect.MakeSlice(reflect.SliceOf(reflect.PtrTo(et)),
+			len(keys), len(keys))
+		err := tc.GetMulti(keys, stored.Interface())
+		me, _ := err.(appengine.MultiError)
+		if err != nil && me == nil {
+			return err
+		}
+
+		for x, key := range keys {
+			var current int64
+			switch {
+			case me != nil && me[x] == datastore.ErrNoSuchEntity:
+			case me != nil && me[x] != nil:
+				return me[x]
+			default:
+				f, err := versionField(stored.Index(x))
+				if err != nil {
+					return err
+				}
+				current = f.Int()
+			}
+
+			if current != versions[x] {
+				return ErrConflict.Wrap(&VersionConflict{key, current})
+			}
+			fields[x].SetInt(versions[x] + 1)
+		}
+
+		_, err = tc.PutMulti(keys, values)
+		return err
+	}
+
+	opts := &TransactionOptions{XG: len(entityGroups(keys)) > 1}
+	if !RunInTransactionOrFail(c, w, r, fn, opts) {
+		// Don't leave the incremented versions behind.
+		for x := range fields {
+			fields[x].SetInt(versions[x])
+		}
+		return false
+	}
+
+	return true
+}
+
+// versionField returns the field of the struct tagged as its version.
+func versionField(v reflect.Value) (reflect.Value, error) {
+	if v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("no version in %s", v.Kind())
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("gorca") != "version" {
+			continue
+		}
+
+		switch f := v.Field(i); f.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+			reflect.Int64:
+
+			return f, nil
+		}
+		return reflect.Value{}, fmt.Errorf("version of %s is not an int", t)
+	}
+
+	return reflect.Value{}, fmt.Errorf("%s has no version field", t)
+}
+
+// entityGroups returns the root keys of the keys.
+func entityGroups(keys []*datastore.Key) map[string]bool {
+	roots := make(map[string]bool)
+	for _, key := range keys {
+		roots[rootKey(key).String()] = true
+	}
+
+	return roots
+}
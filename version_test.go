@@ -0,0 +1,134 @@
+// Copyright 2013 Joshua Marsh. All rights reserved.  Use of this
+// source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package gorca
+
+import (
+	"github.com/icub3d/gorca/internal/testhelper"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// versionItem is a versioned entity.
+type versionItem struct {
+	Name    string
+	Version int64 `gorca:"version"`
+}
+
+func TestPutVersionedKeys(t *testing.T) {
+	h := testhelper.New(t)
+
+	c := NewStandaloneContext()
+	milk := c.NewKey("Item", "milk", 0, nil)
+	eggs := c.NewKey("Item", "eggs", 0, nil)
+
+	tests := []struct {
+		keys      []*datastore.Key
+		values    interface{}
+		result    bool
+		ecode     int
+		ebody     string
+		eversions []int64
+		estored   []int64
+	}{
+		// A new entity.
+		{
+			keys:      []*datastore.Key{milk},
+			values:    []*versionItem{{"milk", 0}},
+			result:    true,
+			eversions: []int64{1},
+			estored:   []int64{1},
+		},
+
+		// An update.
+		{
+			keys:      []*datastore.Key{milk},
+			values:    []versionItem{{"milk", 1}},
+			result:    true,
+			eversions: []int64{2},
+			estored:   []int64{2},
+		},
+
+		// A stale update.
+		{
+			keys:   []*datastore.Key{milk},
+			values: []*versionItem{{"old milk", 1}},
+			ecode:  http.StatusConflict,
+			ebody: `{"Type":"error","Message":"The entity was changed ` +
+				`by someone else.","Version":2}`,
+			eversions: []int64{1},
+			estored:   []int64{2},
+		},
+
+		// Nothing is saved if any are stale.
+		{
+			keys:   []*datastore.Key{eggs, milk},
+			values: []*versionItem{{"eggs", 0}, {"milk", 3}},
+			ecode:  http.StatusConflict,
+			ebody: `{"Type":"error","Message":"The entity was changed ` +
+				`by someone else.","Version":2}`,
+			eversions: []int64{0, 3},
+			estored:   []int64{0, 2},
+		},
+
+		// Several at once.
+		{
+			keys:      []*datastore.Key{eggs, milk},
+			values:    []*versionItem{{"eggs", 0}, {"milk", 2}},
+			result:    true,
+			eversions: []int64{1, 3},
+			estored:   []int64{1, 3},
+		},
+
+		// No version.
+		{
+			keys:   []*datastore.Key{milk},
+			values: []*stringer{{"milk"}},
+			ecode:  http.StatusInternalServerError,
+			ebody:  `{"Type":"error","Message":"Something unexpected happened."}`,
+		},
+	}
+
+	for k, test := range tests {
+		h.SetIndex(k)
+
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("PUT", "/items", nil)
+		h.FatalNotNil("creating request", err)
+
+		result := PutVersionedKeys(c, w, r, test.keys, test.values)
+		h.ErrorNotEqual("result", result, test.result)
+		if !test.result {
+			h.ErrorNotEqual("response code", w.Code, test.ecode)
+			h.ErrorNotEqual("response body", w.Body.String(), test.ebody)
+		}
+		if test.eversions == nil {
+			continue
+		}
+
+		// Check the versions in the values and the datastore.
+		var versions []int64
+		switch values := test.values.(type) {
+		case []versionItem:
+			for _, v := range values {
+				versions = append(versions, v.Version)
+			}
+		case []*versionItem:
+			for _, v := range values {
+				versions = append(versions, v.Version)
+			}
+		}
+		h.ErrorNotEqual("versions", versions, test.eversions)
+
+		stored := make([]versionItem, len(test.keys))
+		c.GetMulti(test.keys, stored)
+		versions = versions[:0]
+		for _, v := range stored {
+			versions = append(versions, v.Version)
+		}
+		h.ErrorNotEqual("stored", versions, test.estored)
+	}
+}